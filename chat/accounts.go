@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrNoAccount is returned when there is no local account with a username.
+	ErrNoAccount = errors.New("chat: no such account")
+	// ErrAccountExists is returned when registering a username that is taken.
+	ErrAccountExists = errors.New("chat: username is already taken")
+	// ErrBadCredentials is returned when a username or password is wrong.
+	ErrBadCredentials = errors.New("chat: wrong username or password")
+	// ErrInvalidUsername is returned when a username does not match usernamePattern.
+	ErrInvalidUsername = errors.New("chat: username must be 3-32 lowercase letters, digits, '.', '_' or '-'")
+	// ErrWeakPassword is returned when a password is shorter than minPasswordLength.
+	ErrWeakPassword = fmt.Errorf("chat: password must be at least %d characters", minPasswordLength)
+	// ErrPasswordTooLong is returned when a password is longer than maxPasswordLength.
+	ErrPasswordTooLong = fmt.Errorf("chat: password must be at most %d bytes", maxPasswordLength)
+)
+
+// minPasswordLength is the shortest password accepted at registration.
+const minPasswordLength = 8
+
+// maxPasswordLength is bcrypt's limit; longer passwords would be truncated.
+const maxPasswordLength = 72
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{3,32}$`)
+
+// account is a local user who logs in with a username and password.
+type account struct {
+	Username     string    `json:"username"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email,omitempty"`
+	PasswordHash []byte    `json:"password_hash"`
+	Created      time.Time `json:"created"`
+}
+
+// UserStore keeps local accounts.
+type UserStore interface {
+	// Create adds acct, or returns ErrAccountExists.
+	Create(acct *account) error
+	// Get returns the account of username, or ErrNoAccount.
+	Get(username string) (*account, error)
+}
+
+// MemoryUserStore keeps accounts in memory only, e.g. for tests.
+type MemoryUserStore struct {
+	mu       sync.Mutex
+	accounts map[string]*account
+}
+
+// NewMemoryUserStore makes an empty MemoryUserStore.
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{accounts: make(map[string]*account)}
+}
+
+// Create is ...
+func (s *MemoryUserStore) Create(acct *account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[acct.Username]; ok {
+		return ErrAccountExists
+	}
+	copied := *acct
+	s.accounts[acct.Username] = &copied
+	return nil
+}
+
+// Get is ...
+func (s *MemoryUserStore) Get(username string) (*account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acct, ok := s.accounts[username]
+	if !ok {
+		return nil, ErrNoAccount
+	}
+	copied := *acct
+	return &copied, nil
+}
+
+// FileUserStore is a MemoryUserStore that writes every new account
+// to a JSON file.
+type FileUserStore struct {
+	*MemoryUserStore
+	filename string
+}
+
+// NewFileUserStore loads the accounts saved in filename, if any.
+func NewFileUserStore(filename string) (*FileUserStore, error) {
+	s := &FileUserStore{MemoryUserStore: NewMemoryUserStore(), filename: filename}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.accounts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Create is ...
+func (s *FileUserStore) Create(acct *account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[acct.Username]; ok {
+		return ErrAccountExists
+	}
+	copied := *acct
+	s.accounts[acct.Username] = &copied
+	data, err := json.Marshal(s.accounts)
+	if err != nil {
+		return err
+	}
+	// FileSessionStore 처럼 임시 파일에 쓰고 rename 한다.
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		delete(s.accounts, acct.Username)
+		return err
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		delete(s.accounts, acct.Username)
+		return err
+	}
+	return nil
+}
+
+// accountsBucket is the bolt bucket accounts are kept in, by username.
+var accountsBucket = []byte("accounts")
+
+// BoltUserStore keeps accounts in an embedded bolt database, which does
+// not rewrite every account on each registration like FileUserStore.
+type BoltUserStore struct {
+	db *bolt.DB
+}
+
+// NewBoltUserStore opens or creates the database in filename.
+func NewBoltUserStore(filename string) (*BoltUserStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(accountsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltUserStore{db: db}, nil
+}
+
+// Create is ...
+func (s *BoltUserStore) Create(acct *account) error {
+	data, err := json.Marshal(acct)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(accountsBucket)
+		if b.Get([]byte(acct.Username)) != nil {
+			return ErrAccountExists
+		}
+		return b.Put([]byte(acct.Username), data)
+	})
+}
+
+// Get is ...
+func (s *BoltUserStore) Get(username string) (*account, error) {
+	var acct *account
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(accountsBucket).Get([]byte(username))
+		if data == nil {
+			return ErrNoAccount
+		}
+		acct = new(account)
+		return json.Unmarshal(data, acct)
+	})
+	return acct, err
+}
+
+// Close closes the database.
+func (s *BoltUserStore) Close() error {
+	return s.db.Close()
+}
+
+// localAccounts registers and authenticates local accounts.
+type localAccounts struct {
+	store UserStore
+	cost  int
+	// allowRegistration lets anyone create an account from the login page.
+	allowRegistration bool
+	// dummyHash is compared against when the username does not exist,
+	// so both failures take as long.
+	dummyHash []byte
+}
+
+// accounts is the local account provider, nil when it is disabled.
+var accounts *localAccounts
+
+func newLocalAccounts(store UserStore, cost int) (*localAccounts, error) {
+	dummy, err := bcrypt.GenerateFromPassword([]byte("not a real password"), cost)
+	if err != nil {
+		return nil, err
+	}
+	return &localAccounts{store: store, cost: cost, allowRegistration: true, dummyHash: dummy}, nil
+}
+
+// Register creates a local account.
+func (a *localAccounts) Register(username, password, name, email string) (*account, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	if len(password) < minPasswordLength {
+		return nil, ErrWeakPassword
+	}
+	if len(password) > maxPasswordLength {
+		return nil, ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), a.cost)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = username
+	}
+	acct := &account{
+		Username:     username,
+		Name:         name,
+		Email:        strings.TrimSpace(email),
+		PasswordHash: hash,
+		Created:      time.Now(),
+	}
+	if err := a.store.Create(acct); err != nil {
+		return nil, err
+	}
+	return acct, nil
+}
+
+// Authenticate returns the account if password is right, or ErrBadCredentials.
+func (a *localAccounts) Authenticate(username, password string) (*account, error) {
+	acct, err := a.store.Get(strings.ToLower(strings.TrimSpace(username)))
+	if err == ErrNoAccount {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return nil, ErrBadCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword(acct.PasswordHash, []byte(password)) != nil {
+		return nil, ErrBadCredentials
+	}
+	return acct, nil
+}
+
+// localUser is the ChatUser of a local account.
+type localUser struct {
+	*account
+}
+
+// UniqueID is derived from the username and not the email like OAuth
+// users, since a local email is not verified and must not let anyone
+// take over the ID of another user.
+func (u localUser) UniqueID() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte("local:"+u.Username)))
+}
+
+// AvatarURL is always empty; local users rely on uploads or identicons.
+func (u localUser) AvatarURL() string {
+	return ""
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLocalAccounts(t *testing.T) {
+	a, err := newLocalAccounts(NewMemoryUserStore(), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct, err := a.Register(" Alice ", "correct horse", "", "alice@example.com")
+	if err != nil {
+		t.Fatalf("Register should not return an error: %s", err)
+	}
+	if acct.Username != "alice" || acct.Name != "alice" || string(acct.PasswordHash) == "correct horse" {
+		t.Errorf("Register wrongly created %+v", acct)
+	}
+	for _, test := range []struct {
+		username, password string
+		err                error
+	}{
+		{"alice", "another password", ErrAccountExists},
+		{"al", "correct horse", ErrInvalidUsername},
+		{"bob/../x", "correct horse", ErrInvalidUsername},
+		{"bob", "short", ErrWeakPassword},
+		{"bob", strings.Repeat("x", maxPasswordLength+1), ErrPasswordTooLong},
+	} {
+		if _, err := a.Register(test.username, test.password, "", ""); err != test.err {
+			t.Errorf("Register(%q, %q) should return %v, got %v", test.username, test.password, test.err, err)
+		}
+	}
+
+	if got, err := a.Authenticate("ALICE", "correct horse"); err != nil || got.Username != "alice" {
+		t.Errorf("Authenticate wrongly returned %v, %v", got, err)
+	}
+	if _, err := a.Authenticate("alice", "wrong horse"); err != ErrBadCredentials {
+		t.Errorf("Authenticate should return ErrBadCredentials for a wrong password, got %v", err)
+	}
+	if _, err := a.Authenticate("nobody", "correct horse"); err != ErrBadCredentials {
+		t.Errorf("Authenticate should return ErrBadCredentials for an unknown user, got %v", err)
+	}
+
+	// 같은 이메일이라도 OAuth 사용자와 ID 가 겹치지 않는다.
+	oauth := &chatUser{uniqueID: "c160f8cc69a4f0bf2b0362752353d060"}
+	if (localUser{acct}).UniqueID() == oauth.UniqueID() {
+		t.Error("local users should not share IDs with OAuth users")
+	}
+}
+
+func TestUserStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]func() (UserStore, error){
+		"file": func() (UserStore, error) { return NewFileUserStore(filepath.Join(dir, "accounts.json")) },
+		"bolt": func() (UserStore, error) { return NewBoltUserStore(filepath.Join(dir, "accounts.db")) },
+	}
+	for name, open := range stores {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if err := s.Create(&account{Username: "alice", PasswordHash: []byte("hash")}); err != nil {
+			t.Errorf("%s: Create should not return an error: %s", name, err)
+		}
+		if err := s.Create(&account{Username: "alice"}); err != ErrAccountExists {
+			t.Errorf("%s: Create should return ErrAccountExists, got %v", name, err)
+		}
+		if closer, ok := s.(interface{ Close() error }); ok {
+			closer.Close()
+		}
+
+		// reopen
+		s, err = open()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if acct, err := s.Get("alice"); err != nil || string(acct.PasswordHash) != "hash" {
+			t.Errorf("%s: Get wrongly returned %v, %v", name, acct, err)
+		}
+		if _, err := s.Get("bob"); err != ErrNoAccount {
+			t.Errorf("%s: Get should return ErrNoAccount, got %v", name, err)
+		}
+		if closer, ok := s.(interface{ Close() error }); ok {
+			closer.Close()
+		}
+	}
+}
+
+func TestLocalAuthHandler(t *testing.T) {
+	newTestSession(t, "setup") // tokens and sessions
+	var err error
+	defer func(old *localAccounts) { accounts = old }(accounts)
+	if accounts, err = newLocalAccounts(NewMemoryUserStore(), bcrypt.MinCost); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		localAuthHandler(w, req)
+		return w
+	}
+	form := url.Values{"username": {"bob"}, "password": {"correct horse"}, "name": {"Bob"}}
+
+	w := post("/auth/local/register", form)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/chat" {
+		t.Fatalf("register wrongly returned %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := post("/auth/local/register", form); w.Header().Get("Location") != "/login?error=exists" {
+		t.Errorf("register should refuse a taken username, went to %s", w.Header().Get("Location"))
+	}
+	long := url.Values{"username": {"dave"}, "password": {strings.Repeat("x", maxPasswordLength+1)}}
+	if w := post("/auth/local/register", long); w.Header().Get("Location") != "/login?error=toolong" {
+		t.Errorf("register should refuse a password bcrypt would truncate, went to %s", w.Header().Get("Location"))
+	}
+	form.Set("password", "wrong horse")
+	if w := post("/auth/local/login", form); w.Header().Get("Location") != "/login?error=credentials" {
+		t.Errorf("login should refuse a wrong password, went to %s", w.Header().Get("Location"))
+	}
+
+	form.Set("password", "correct horse")
+	w = post("/auth/local/login", form)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login wrongly returned %d", w.Code)
+	}
+	// 로그인이 OAuth 와 같은 세션과 쿠키를 만든다.
+	req := httptest.NewRequest(http.MethodGet, "/chat", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	sess, err := currentSession(req)
+	if err != nil {
+		t.Fatalf("login should issue an auth cookie: %s", err)
+	}
+	acct, _ := accounts.store.Get("bob")
+	if sess.UserID != (localUser{acct}).UniqueID() || sess.Data["name"] != "Bob" {
+		t.Errorf("login wrongly created session %+v", sess)
+	}
+
+	accounts.allowRegistration = false
+	form.Set("username", "carol")
+	if w := post("/auth/local/register", form); w.Header().Get("Location") != "/login?error=closed" {
+		t.Errorf("register should be refused when closed, went to %s", w.Header().Get("Location"))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/stretchr/gomniauth"
@@ -50,15 +51,29 @@ func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// }
 
 	// ch3: 빈 쿠키값 대비
-	if cookie, err := r.Cookie("auth"); err == http.ErrNoCookie || cookie.Value == "" {
+	// if cookie, err := r.Cookie("auth"); err == http.ErrNoCookie || cookie.Value == "" {
+	// 	// not authenticated
+	// 	w.Header().Set("Location", "/login")
+	// 	w.WriteHeader(http.StatusTemporaryRedirect)
+	// 	return
+	// } else if err != nil {
+	// 	// some other error
+	// 	http.Error(w, err.Error(), http.StatusInternalServerError)
+	// 	return
+	// }
+
+	// 쿠키가 없거나, 서명이 맞지 않거나, 만료된 경우 모두 로그인 페이지로 보낸다.
+	if _, err := currentUser(r); err != nil {
 		// not authenticated
-		w.Header().Set("Location", "/login")
+		// w.Header().Set("Location", "/login")
+		// 로그인한 뒤 원래 보던 페이지로 돌아오도록 주소를 넘긴다.
+		location := "/login"
+		if r.Method == http.MethodGet {
+			location += "?next=" + url.QueryEscape(r.URL.RequestURI())
+		}
+		w.Header().Set("Location", location)
 		w.WriteHeader(http.StatusTemporaryRedirect)
 		return
-	} else if err != nil {
-		// some other error
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
 
 	// success - call the next handler
@@ -71,43 +86,62 @@ func MustAuth(handler http.Handler) http.Handler {
 }
 
 // loginHandler handles the third-party login process.
-// format: /auth/{action}/{provider}
+// format: /auth/{action}/{provider}, /auth/login/{provider}?next={path}
 // loginHanlder 는 http.Handler 를 구현하는 개체를 갖지 않는다. 여기서는 따로 상태(state)를 저장할 필요가 없기 때문이다.
 // 따라서 main.go 에서 http.HandleFunc 을 통해 이 함수를 사용한다.
+// 로그인 중인 상태는 loginStates 에 저장한다. (state.go)
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	segs := strings.Split(r.URL.Path, "/")
-	action := segs[2]
-	provider := segs[3] // 이 코드는 나중에 panic 을 일으킬 수 있음. /auth/nonsense 처럼 segs[3]이 없는 경로로 접근하면..
+	// segs := strings.Split(r.URL.Path, "/")
+	// action := segs[2]
+	// provider := segs[3] // 이 코드는 나중에 panic 을 일으킬 수 있음. /auth/nonsense 처럼 segs[3]이 없는 경로로 접근하면..
+	action, provider, ok := parseAuthPath(r.URL.Path)
+	if !ok {
+		errorPage(w, r, http.StatusNotFound, "Page not found", nil)
+		return
+	}
+	// OpenID Connect provider 는 gomniauth 를 거치지 않는다. (oidc.go)
+	if p, ok := oidcProviders[provider]; ok {
+		oidcLogin(w, r, action, p)
+		return
+	}
+	p, err := gomniauth.Provider(provider)
+	if err != nil {
+		errorPage(w, r, http.StatusNotFound, "Unknown sign in service "+provider, err)
+		return
+	}
 	switch action {
 	case "login":
-		provider, err := gomniauth.Provider(provider)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to get provider %s: %s", provider, err), http.StatusBadRequest)
-			return
-		}
-		loginURL, err := provider.GetBeginAuthURL(nil, nil)
+		// loginURL, err := provider.GetBeginAuthURL(nil, nil)
+		// state 가 없으면 다른 사람의 callback 주소로 로그인시키는 CSRF 가 가능하다.
+		state, _ := loginStates.begin(w, provider, r.URL.Query().Get("next"))
+		loginURL, err := p.GetBeginAuthURL(gomniauth.NewState("id", state), nil)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to GetBeginAuthURL for %s: %s", provider, err), http.StatusInternalServerError)
+			errorPage(w, r, http.StatusBadGateway, "Could not reach "+provider, err)
 			return
 		}
 		w.Header().Set("Location", loginURL)
 		w.WriteHeader(http.StatusTemporaryRedirect)
 	case "callback":
-		provider, err := gomniauth.Provider(provider)
+		var id string
+		if state, err := gomniauth.StateFromParam(r.URL.Query().Get("state")); err == nil {
+			id = state.Get("id").Str()
+		}
+		ls, err := loginStates.complete(w, r, provider, id)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to get provider %s: %s", provider, err), http.StatusBadRequest)
+			errorPage(w, r, http.StatusBadRequest, "Your sign in has expired, please try again", err)
 			return
 		}
-		creds, err := provider.CompleteAuth(objx.MustFromURLQuery(r.URL.RawQuery))
+		creds, err := p.CompleteAuth(objx.MustFromURLQuery(r.URL.RawQuery))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error when trying to complete auth for %s: %s", provider, err), http.StatusInternalServerError)
+			errorPage(w, r, http.StatusBadGateway, "Could not complete sign in with "+provider, err)
 			return
 		}
-		user, err := provider.GetUser(creds)
+		user, err := p.GetUser(creds)
 		if err != nil {
-			log.Fatalln("Error when trying to get user from", provider, "-", err)
-			// http.Error(w, fmt.Sprintf("Error when trying to get user from %s: %s", provider, err), http.StatusInternalServerError)
-			// return
+			// log.Fatalln("Error when trying to get user from", provider, "-", err)
+			// 서버 전체가 죽으면 안 된다.
+			errorPage(w, r, http.StatusBadGateway, "Could not get your profile from "+provider, err)
+			return
 		}
 		chatUser := &chatUser{User: user}
 		m := md5.New()
@@ -115,26 +149,166 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		chatUser.uniqueID = fmt.Sprintf("%x", m.Sum(nil))
 		avatarURL, err := avatars.GetAvatarURL(chatUser)
 		if err != nil {
-			log.Fatalln("Error when trying to GetAvatarURL", "-", err)
+			// log.Fatalln("Error when trying to GetAvatarURL", "-", err)
+			// 아바타가 없어도 로그인은 된다.
+			log.Println("Error when trying to GetAvatarURL", "-", err)
 		}
 		// userID := fmt.Sprintf("%x", m.Sum(nil))
-		authCookieValue := objx.New(map[string]interface{}{
-			// "userid":     userID,
-			"userid": chatUser.uniqueID,
-			"name":   user.Name(),
-			// "avatar_url": user.AvatarURL(),
-			"avatar_url": avatarURL,
-			// "email":      user.Email(),
-		}).MustBase64()
-		http.SetCookie(w, &http.Cookie{
-			Name:  "auth",
-			Value: authCookieValue,
-			Path:  "/",
-		})
-		w.Header().Set("Location", "/chat")
+		// authCookieValue := objx.New(map[string]interface{}{ ... }).MustBase64()
+		// 쿠키 값은 서버 키로 서명해서 위조할 수 없게 한다. (token.go)
+		// 사용자 정보는 서버의 세션에 저장하고, 쿠키에는 세션 ID 만 담는다. (session.go)
+		if err := startSession(w, r, chatUser.uniqueID, user.Name(), avatarURL); err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Could not sign you in", err)
+			return
+		}
+		w.Header().Set("Location", ls.Next)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}
+}
+
+// authActions are the actions of /auth/{action}/{provider}.
+var authActions = map[string]bool{"login": true, "callback": true}
+
+// parseAuthPath splits /auth/{action}/{provider}, reporting false for
+// any other shape instead of indexing past the end.
+func parseAuthPath(path string) (action, provider string, ok bool) {
+	segs := strings.Split(strings.TrimPrefix(path, "/auth/"), "/")
+	if !strings.HasPrefix(path, "/auth/") || len(segs) != 2 || !authActions[segs[0]] ||
+		!providerNamePattern.MatchString(segs[1]) {
+		return "", "", false
+	}
+	return segs[0], segs[1], true
+}
+
+// oidcLogin is loginHandler for an OpenID Connect provider.
+func oidcLogin(w http.ResponseWriter, r *http.Request, action string, p *oidcProvider) {
+	switch action {
+	case "login":
+		state, ls := loginStates.begin(w, p.name, r.URL.Query().Get("next"))
+		loginURL, err := p.BeginAuth(state, ls)
+		if err != nil {
+			errorPage(w, r, http.StatusBadGateway, "Could not reach "+p.name, err)
+			return
+		}
+		w.Header().Set("Location", loginURL)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	case "callback":
+		ls, err := loginStates.complete(w, r, p.name, r.URL.Query().Get("state"))
+		if err != nil {
+			errorPage(w, r, http.StatusBadRequest, "Your sign in has expired, please try again", err)
+			return
+		}
+		user, err := p.CompleteAuth(r.URL.Query(), ls)
+		if err != nil {
+			errorPage(w, r, http.StatusUnauthorized, "Could not complete sign in with "+p.name, err)
+			return
+		}
+		avatarURL, _ := avatars.GetAvatarURL(user)
+		if err := startSession(w, r, user.UniqueID(), user.Name(), avatarURL); err != nil {
+			errorPage(w, r, http.StatusInternalServerError, "Could not sign you in", err)
+			return
+		}
+		w.Header().Set("Location", ls.Next)
 		w.WriteHeader(http.StatusTemporaryRedirect)
+	}
+}
+
+// startSession creates a session for the user and sets the auth cookie,
+// the same way for OAuth and local accounts.
+func startSession(w http.ResponseWriter, r *http.Request, userID, name, avatarURL string) error {
+	sess, err := sessions.Create(map[string]interface{}{
+		// "userid":     userID,
+		"userid": userID,
+		"name":   name,
+		// "avatar_url": user.AvatarURL(),
+		"avatar_url": avatarURL,
+		// "email":      user.Email(),
+	}, r.UserAgent())
+	if err != nil {
+		return fmt.Errorf("Error when trying to create session: %s", err)
+	}
+	users.login(sess.Data)
+	if err := setAuthCookie(w, map[string]interface{}{"sid": sess.ID}); err != nil {
+		return fmt.Errorf("Error when trying to issue auth cookie: %s", err)
+	}
+	return nil
+}
+
+// loginErrors are the messages the login page shows for ?error=.
+// 임의의 문구를 주소로 받지 않도록 코드만 넘긴다.
+var loginErrors = map[string]string{
+	"credentials": ErrBadCredentials.Error(),
+	"exists":      ErrAccountExists.Error(),
+	"username":    ErrInvalidUsername.Error(),
+	"password":    ErrWeakPassword.Error(),
+	"toolong":     ErrPasswordTooLong.Error(),
+	"closed":      "Registration is closed",
+}
+
+// localAuthHandler logs in and registers local accounts.
+// format: POST /auth/local/login, POST /auth/local/register (username, password, name, email)
+func localAuthHandler(w http.ResponseWriter, r *http.Request) {
+	if accounts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var acct *account
+	var err error
+	switch r.URL.Path {
+	case "/auth/local/login":
+		acct, err = accounts.Authenticate(r.PostFormValue("username"), r.PostFormValue("password"))
+	case "/auth/local/register":
+		if !accounts.allowRegistration {
+			loginFailed(w, r, "closed")
+			return
+		}
+		acct, err = accounts.Register(r.PostFormValue("username"), r.PostFormValue("password"),
+			r.PostFormValue("name"), r.PostFormValue("email"))
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Autho action %s not supported", action)
+		http.NotFound(w, r)
+		return
+	}
+	switch err {
+	case nil:
+	case ErrBadCredentials:
+		loginFailed(w, r, "credentials")
+		return
+	case ErrAccountExists:
+		loginFailed(w, r, "exists")
+		return
+	case ErrInvalidUsername:
+		loginFailed(w, r, "username")
+		return
+	case ErrWeakPassword:
+		loginFailed(w, r, "password")
+		return
+	case ErrPasswordTooLong:
+		loginFailed(w, r, "toolong")
+		return
+	default:
+		errorPage(w, r, http.StatusInternalServerError, "Could not sign you in", err)
+		return
+	}
+
+	user := localUser{acct}
+	// 아바타를 못 찾아도 로그인은 된다. (identicon 등으로 채울 수 있다)
+	avatarURL, _ := avatars.GetAvatarURL(user)
+	if err := startSession(w, r, user.UniqueID(), acct.Name, avatarURL); err != nil {
+		errorPage(w, r, http.StatusInternalServerError, "Could not sign you in", err)
+		return
+	}
+	http.Redirect(w, r, safeNext(r.PostFormValue("next")), http.StatusSeeOther)
+}
+
+// loginFailed sends the user back to the login page with an error code.
+func loginFailed(w http.ResponseWriter, r *http.Request, code string) {
+	location := "/login?error=" + code
+	if next := r.PostFormValue("next"); next != "" {
+		location += "&next=" + url.QueryEscape(safeNext(next))
 	}
+	http.Redirect(w, r, location, http.StatusSeeOther)
 }
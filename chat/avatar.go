@@ -2,10 +2,18 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"path"
+	"strconv"
+
+	"github.com/jihuichoi/GPB/trace"
 )
 
+// avatarsDir is where uploaded avatars are kept.
+var avatarsDir = "avatars"
+
 // ErrNoAvatarURL ErrNoAvatar is the error that is returned when the
 // Avatar instance is unable to provide an avatar URL.
 var ErrNoAvatarURL = errors.New("chat: Unable to get an avatar URL")
@@ -21,17 +29,60 @@ type Avatar interface {
 	GetAvatarURL(ChatUser) (string, error)
 }
 
+// avatarTracer reports which avatar strategy was used for each login
+// and why the others failed.
+var avatarTracer = trace.Off()
+
+// AvatarAttempt is the outcome of one strategy of a TryAvatars chain.
+type AvatarAttempt struct {
+	Strategy string
+	URL      string
+	Err      error
+}
+
+func (a AvatarAttempt) String() string {
+	if a.Err != nil {
+		return a.Strategy + ": " + a.Err.Error()
+	}
+	return a.Strategy + ": " + a.URL
+}
+
+// avatarName returns the name of a strategy for reports.
+func avatarName(a Avatar) string {
+	if named, ok := a.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", a)
+}
+
 // TryAvatars is ...
 type TryAvatars []Avatar
 
 // GetAvatarURL is ...
 func (a TryAvatars) GetAvatarURL(u ChatUser) (string, error) {
+	// for _, avatar := range a {
+	// 	if url, err := avatar.GetAvatarURL(u); err == nil {
+	// 		return url, nil
+	// 	}
+	// }
+	// return "", ErrNoAvatarURL
+	url, attempts, err := a.Explain(u)
+	avatarTracer.Trace("Avatar for ", u.UniqueID(), ": ", attempts)
+	return url, err
+}
+
+// Explain tries the strategies in order like GetAvatarURL and also
+// returns what every strategy tried did, the successful one last.
+func (a TryAvatars) Explain(u ChatUser) (string, []AvatarAttempt, error) {
+	var attempts []AvatarAttempt
 	for _, avatar := range a {
-		if url, err := avatar.GetAvatarURL(u); err == nil {
-			return url, nil
+		url, err := avatar.GetAvatarURL(u)
+		attempts = append(attempts, AvatarAttempt{Strategy: avatarName(avatar), URL: url, Err: err})
+		if err == nil {
+			return url, attempts, nil
 		}
 	}
-	return "", ErrNoAvatarURL
+	return "", attempts, ErrNoAvatarURL
 }
 
 // AuthAvatar is ...
@@ -57,8 +108,16 @@ func (AuthAvatar) GetAvatarURL(u ChatUser) (string, error) {
 	return url, nil
 }
 
+// Name is ...
+func (AuthAvatar) Name() string { return "auth" }
+
 // GravatarAvatar is ...
-type GravatarAvatar struct{}
+// Default, Size and Rating are passed to Gravatar as d, s and r when set.
+type GravatarAvatar struct {
+	Default string // e.g. "identicon", "mp", "404" or an image URL
+	Size    int
+	Rating  string // g, pg, r or x
+}
 
 // UseGravatar is ...
 var UseGravatar GravatarAvatar
@@ -79,12 +138,36 @@ var UseGravatar GravatarAvatar
 // 	}
 // 	return "", ErrNoAvatarURL
 // }
-func (GravatarAvatar) GetAvatarURL(u ChatUser) (string, error) {
-	return "//www.gravatar.com/avatar/" + u.UniqueID(), nil
+func (a GravatarAvatar) GetAvatarURL(u ChatUser) (string, error) {
+	// return "//www.gravatar.com/avatar/" + u.UniqueID(), nil
+	if u.UniqueID() == "" {
+		return "", fmt.Errorf("%w: no unique ID", ErrNoAvatarURL)
+	}
+	q := url.Values{}
+	if a.Default != "" {
+		q.Set("d", a.Default)
+	}
+	if a.Size > 0 {
+		q.Set("s", strconv.Itoa(a.Size))
+	}
+	if a.Rating != "" {
+		q.Set("r", a.Rating)
+	}
+	if len(q) == 0 {
+		return "//www.gravatar.com/avatar/" + u.UniqueID(), nil
+	}
+	return "//www.gravatar.com/avatar/" + u.UniqueID() + "?" + q.Encode(), nil
 }
 
+// Name is ...
+func (GravatarAvatar) Name() string { return "gravatar" }
+
 // FileSystemAvatar is ...
-type FileSystemAvatar struct{}
+// Dir defaults to avatarsDir and URLPrefix to "/avatars/".
+type FileSystemAvatar struct {
+	Dir       string
+	URLPrefix string
+}
 
 // UseFileSystemAvatar is ...
 var UseFileSystemAvatar FileSystemAvatar
@@ -110,16 +193,78 @@ var UseFileSystemAvatar FileSystemAvatar
 // 	}
 // 	return "", ErrNoAvatarURL
 // }
-func (FileSystemAvatar) GetAvatarURL(u ChatUser) (string, error) {
-	if files, err := ioutil.ReadDir("avatars"); err == nil {
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			if match, _ := path.Match(u.UniqueID()+"*", file.Name()); match {
-				return "/avatars/" + file.Name(), nil
-			}
+func (a FileSystemAvatar) GetAvatarURL(u ChatUser) (string, error) {
+	// 빈 ID는 모든 파일과 매치되므로 거부
+	if u.UniqueID() == "" {
+		return "", fmt.Errorf("%w: no unique ID", ErrNoAvatarURL)
+	}
+	dir, prefix := a.Dir, a.URLPrefix
+	if dir == "" {
+		dir = avatarsDir
+	}
+	if prefix == "" {
+		prefix = "/avatars/"
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrNoAvatarURL, err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
 		}
+		if match, _ := path.Match(u.UniqueID()+"*", file.Name()); match {
+			return prefix + file.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: no file for %s in %s", ErrNoAvatarURL, u.UniqueID(), dir)
+}
+
+// Name is ...
+func (FileSystemAvatar) Name() string { return "filesystem" }
+
+// FallbackAvatar always returns the same URL, e.g. a default picture
+// at the end of a TryAvatars chain.
+type FallbackAvatar struct {
+	URL string
+}
+
+// GetAvatarURL is ...
+func (a FallbackAvatar) GetAvatarURL(ChatUser) (string, error) {
+	if a.URL == "" {
+		return "", fmt.Errorf("%w: no fallback URL configured", ErrNoAvatarURL)
 	}
-	return "", ErrNoAvatarURL
+	return a.URL, nil
 }
+
+// Name is ...
+func (FallbackAvatar) Name() string { return "fallback" }
+
+// IdenticonAvatar points to a pattern drawn from the user's unique ID by
+// identiconHandler. It needs neither an upload nor the internet, so it
+// fits at the end of a TryAvatars chain.
+type IdenticonAvatar struct {
+	URLPrefix string // defaults to "/identicons/"
+	Format    string // "png" (default) or "svg"
+}
+
+// UseIdenticonAvatar is ...
+var UseIdenticonAvatar IdenticonAvatar
+
+// GetAvatarURL is ...
+func (a IdenticonAvatar) GetAvatarURL(u ChatUser) (string, error) {
+	if u.UniqueID() == "" {
+		return "", fmt.Errorf("%w: no unique ID", ErrNoAvatarURL)
+	}
+	prefix, format := a.URLPrefix, a.Format
+	if prefix == "" {
+		prefix = "/identicons/"
+	}
+	if format == "" {
+		format = "png"
+	}
+	return prefix + url.PathEscape(u.UniqueID()) + "." + format, nil
+}
+
+// Name is ...
+func (IdenticonAvatar) Name() string { return "identicon" }
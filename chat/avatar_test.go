@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -76,3 +77,130 @@ func TestFileSystemAvatar(t *testing.T) {
 		t.Errorf("FileSystemAvatar.GetAvatarURL wrongly returned %s", url)
 	}
 }
+
+func TestGravatarAvatarOptions(t *testing.T) {
+	gravatarAvatar := GravatarAvatar{Default: "identicon", Size: 64, Rating: "pg"}
+	url, err := gravatarAvatar.GetAvatarURL(&chatUser{uniqueID: "abc"})
+	if err != nil {
+		t.Error("GravatarAvatar.GetAvatarURL should not return an error")
+	}
+	if url != "//www.gravatar.com/avatar/abc?d=identicon&r=pg&s=64" {
+		t.Errorf("GravatarAvatar.GetAvatarURL wrongly returned %s", url)
+	}
+}
+
+func TestFileSystemAvatarOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "abc.png"), []byte{}, 0644)
+
+	fileSystemAvatar := FileSystemAvatar{Dir: dir, URLPrefix: "/pictures/"}
+	url, err := fileSystemAvatar.GetAvatarURL(&chatUser{uniqueID: "abc"})
+	if err != nil {
+		t.Error("FileSystemAvatar.GetAvatarURL should not return an error")
+	}
+	if url != "/pictures/abc.png" {
+		t.Errorf("FileSystemAvatar.GetAvatarURL wrongly returned %s", url)
+	}
+	if _, err := fileSystemAvatar.GetAvatarURL(&chatUser{uniqueID: "def"}); !errors.Is(err, ErrNoAvatarURL) {
+		t.Errorf("FileSystemAvatar.GetAvatarURL should return ErrNoAvatarURL without a file, got %v", err)
+	}
+}
+
+func TestFallbackAvatar(t *testing.T) {
+	if url, err := (FallbackAvatar{URL: "/default.png"}).GetAvatarURL(&chatUser{}); err != nil || url != "/default.png" {
+		t.Errorf("FallbackAvatar.GetAvatarURL wrongly returned %s, %v", url, err)
+	}
+	if _, err := (FallbackAvatar{}).GetAvatarURL(&chatUser{}); !errors.Is(err, ErrNoAvatarURL) {
+		t.Error("FallbackAvatar.GetAvatarURL should return ErrNoAvatarURL without a URL")
+	}
+}
+
+func TestTryAvatars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "uploaded.jpg"), []byte{}, 0644)
+
+	fileSystem := FileSystemAvatar{Dir: dir}
+	gravatar := GravatarAvatar{}
+	fallback := FallbackAvatar{URL: "/default.png"}
+
+	// users: with an uploaded file and a provider picture, with only a
+	// provider picture, and with neither (and no unique ID for Gravatar)
+	newUser := func(id, avatarURL string) ChatUser {
+		testUser := &gomniauthtest.TestUser{}
+		testUser.On("AvatarURL").Return(avatarURL, nil)
+		return &chatUser{User: testUser, uniqueID: id}
+	}
+	uploaded := newUser("uploaded", "http://provider/uploaded.png")
+	provider := newUser("provider", "http://provider/provider.png")
+	nobody := newUser("", "")
+
+	tests := []struct {
+		chain    TryAvatars
+		user     ChatUser
+		url      string
+		attempts []string // strategies tried, the last one succeeded unless url is ""
+	}{
+		{TryAvatars{fileSystem, UseAuthAvatar, gravatar}, uploaded, "/avatars/uploaded.jpg", []string{"filesystem"}},
+		{TryAvatars{fileSystem, UseAuthAvatar, gravatar}, provider, "http://provider/provider.png", []string{"filesystem", "auth"}},
+		{TryAvatars{fileSystem, UseAuthAvatar, gravatar}, nobody, "", []string{"filesystem", "auth", "gravatar"}},
+		{TryAvatars{UseAuthAvatar, fileSystem}, uploaded, "http://provider/uploaded.png", []string{"auth"}},
+		{TryAvatars{gravatar, fileSystem}, uploaded, "//www.gravatar.com/avatar/uploaded", []string{"gravatar"}},
+		{TryAvatars{fileSystem, gravatar}, provider, "//www.gravatar.com/avatar/provider", []string{"filesystem", "gravatar"}},
+		{TryAvatars{fileSystem, UseAuthAvatar, fallback}, nobody, "/default.png", []string{"filesystem", "auth", "fallback"}},
+		{TryAvatars{fallback, fileSystem}, uploaded, "/default.png", []string{"fallback"}},
+		{TryAvatars{}, uploaded, "", nil},
+	}
+	for i, test := range tests {
+		url, attempts, err := test.chain.Explain(test.user)
+		if url != test.url {
+			t.Errorf("%d: TryAvatars.Explain wrongly returned %q, want %q", i, url, test.url)
+		}
+		if (err == nil) != (test.url != "") {
+			t.Errorf("%d: TryAvatars.Explain wrongly returned error %v", i, err)
+		}
+		if len(attempts) != len(test.attempts) {
+			t.Errorf("%d: TryAvatars.Explain reported %v, want %v", i, attempts, test.attempts)
+			continue
+		}
+		for j, attempt := range attempts {
+			if attempt.Strategy != test.attempts[j] {
+				t.Errorf("%d: attempt %d was %s, want %s", i, j, attempt.Strategy, test.attempts[j])
+			}
+			failed := j < len(attempts)-1 || test.url == ""
+			if failed && attempt.Err == nil {
+				t.Errorf("%d: attempt %d should report why it failed", i, j)
+			}
+		}
+		if chainURL, _ := test.chain.GetAvatarURL(test.user); chainURL != url {
+			t.Errorf("%d: TryAvatars.GetAvatarURL should agree with Explain, got %q", i, chainURL)
+		}
+	}
+}
+
+func TestIdenticonAvatar(t *testing.T) {
+	var identiconAvatar IdenticonAvatar
+	url, err := identiconAvatar.GetAvatarURL(&chatUser{uniqueID: "abc"})
+	if err != nil || url != "/identicons/abc.png" {
+		t.Errorf("IdenticonAvatar.GetAvatarURL wrongly returned %s, %v", url, err)
+	}
+	identiconAvatar = IdenticonAvatar{URLPrefix: "/icons/", Format: "svg"}
+	if url, _ := identiconAvatar.GetAvatarURL(&chatUser{uniqueID: "abc"}); url != "/icons/abc.svg" {
+		t.Errorf("IdenticonAvatar.GetAvatarURL wrongly returned %s", url)
+	}
+	if _, err := identiconAvatar.GetAvatarURL(&chatUser{}); !errors.Is(err, ErrNoAvatarURL) {
+		t.Error("IdenticonAvatar.GetAvatarURL should return ErrNoAvatarURL without a unique ID")
+	}
+	// 오프라인에서도 체인의 마지막에서 항상 성공한다.
+	chain := TryAvatars{FileSystemAvatar{Dir: "does-not-exist"}, UseIdenticonAvatar}
+	if url, err := chain.GetAvatarURL(&chatUser{uniqueID: "abc"}); err != nil || url != "/identicons/abc.png" {
+		t.Errorf("TryAvatars should fall back to the identicon, got %s, %v", url, err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// avatarSizes are the sizes that can be asked for with ?s=.
+var avatarSizes = map[int]bool{32: true, 64: true, 128: true}
+
+// maxAvatarVariants bounds the number of resized images kept in memory.
+const maxAvatarVariants = 1024
+
+// avatarCacheControl lets browsers keep avatars for a while and
+// revalidate them with the ETag afterwards.
+const avatarCacheControl = "public, max-age=300"
+
+var avatarIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// validAvatarID reports whether id can be used as an avatar file name.
+func validAvatarID(id string) bool {
+	return avatarIDPattern.MatchString(id)
+}
+
+// avatarSizeParam reads the ?s= size of an avatar request, which is
+// avatarSize when it is not given.
+func avatarSizeParam(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("s")
+	if v == "" {
+		return avatarSize, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && avatarSizes[n]
+}
+
+// avatarVariant is a resized avatar ready to be served.
+type avatarVariant struct {
+	data    []byte
+	etag    string
+	source  time.Time // modification time of the uploaded file, zero for an identicon
+	modTime time.Time
+}
+
+// avatarServer serves uploaded avatars in several sizes and draws an
+// identicon for users who have not uploaded one.
+// format: GET /avatars/{id}[.ext]?s=32|64|128
+type avatarServer struct {
+	dir string
+
+	mu       sync.Mutex
+	variants map[string]*avatarVariant
+}
+
+func newAvatarServer(dir string) *avatarServer {
+	return &avatarServer{dir: dir, variants: make(map[string]*avatarVariant)}
+}
+
+func (s *avatarServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// FileSystemAvatar 가 만든 /avatars/{id}.png 같은 주소도 받는다.
+	name := strings.TrimPrefix(r.URL.Path, "/avatars/")
+	id := strings.TrimSuffix(name, path.Ext(name))
+	if !validAvatarID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	size, ok := avatarSizeParam(r)
+	if !ok {
+		http.Error(w, "size must be one of 32, 64 or 128", http.StatusBadRequest)
+		return
+	}
+
+	variant, err := s.variant(id, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", variant.etag)
+	w.Header().Set("Cache-Control", avatarCacheControl)
+	// ServeContent 가 If-None-Match, If-Modified-Since 를 처리한다.
+	http.ServeContent(w, r, "", variant.modTime, bytes.NewReader(variant.data))
+}
+
+// variant returns the cached image of id at size, making it if the
+// uploaded file changed since it was cached.
+func (s *avatarServer) variant(id string, size int) (*avatarVariant, error) {
+	file, source := s.source(id)
+	key := id + "@" + strconv.Itoa(size)
+	s.mu.Lock()
+	cached, ok := s.variants[key]
+	s.mu.Unlock()
+	if ok && cached.source.Equal(source) {
+		return cached, nil
+	}
+
+	var img image.Image
+	if file != "" {
+		var err error
+		if img, err = decodeAvatarFile(file); err != nil {
+			return nil, err
+		}
+		img = squareThumbnail(img, size)
+	} else {
+		img = identicon(id, size)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(buf.Bytes())
+	variant := &avatarVariant{
+		data:    buf.Bytes(),
+		etag:    `"` + hex.EncodeToString(sum[:]) + `"`,
+		source:  source,
+		modTime: source,
+	}
+	if variant.modTime.IsZero() {
+		variant.modTime = time.Now()
+	}
+
+	s.mu.Lock()
+	if len(s.variants) >= maxAvatarVariants {
+		// 간단하게 전부 비운다. 자주 쓰이는 것은 곧 다시 만들어진다.
+		s.variants = make(map[string]*avatarVariant)
+	}
+	s.variants[key] = variant
+	s.mu.Unlock()
+	return variant, nil
+}
+
+// source finds the uploaded file of id, if any, and its modification time.
+func (s *avatarServer) source(id string) (string, time.Time) {
+	for _, ext := range avatarExts {
+		file := filepath.Join(s.dir, id+ext)
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file, info.ModTime()
+		}
+	}
+	return "", time.Time{}
+}
+
+// decodeAvatarFile decodes an avatar stored on disk.
+func decodeAvatarFile(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// identiconCacheControl allows identicons to be kept for long since they
+// never change for a given ID.
+const identiconCacheControl = "public, max-age=86400"
+
+// identiconHandler draws the identicon of an ID as PNG or SVG.
+// format: GET /identicons/{id}.png|svg?s=32|64|128
+func identiconHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/identicons/")
+	ext := path.Ext(name)
+	id := strings.TrimSuffix(name, ext)
+	if !validAvatarID(id) || (ext != ".png" && ext != ".svg") {
+		http.NotFound(w, r)
+		return
+	}
+	size, ok := avatarSizeParam(r)
+	if !ok {
+		http.Error(w, "size must be one of 32, 64 or 128", http.StatusBadRequest)
+		return
+	}
+
+	var data []byte
+	if ext == ".svg" {
+		data = identiconSVG(id, size)
+		w.Header().Set("Content-Type", "image/svg+xml")
+	} else {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, identicon(id, size)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data = buf.Bytes()
+		w.Header().Set("Content-Type", "image/png")
+	}
+	sum := sha1.Sum(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.Header().Set("Cache-Control", identiconCacheControl)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getAvatar(s *avatarServer, target, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func writeTestAvatar(t *testing.T, file string, c color.Color) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	png.Encode(f, img)
+}
+
+func TestAvatarServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "abc.png")
+	writeTestAvatar(t, file, color.NRGBA{255, 0, 0, 255})
+	s := newAvatarServer(dir)
+
+	for target, status := range map[string]int{
+		"/avatars/abc":          http.StatusOK,
+		"/avatars/abc.png?s=32": http.StatusOK,
+		"/avatars/nobody?s=128": http.StatusOK,
+		"/avatars/abc?s=50":     http.StatusBadRequest,
+		"/avatars/abc?s=x":      http.StatusBadRequest,
+		"/avatars/../secret":    http.StatusNotFound,
+		"/avatars/":             http.StatusNotFound,
+	} {
+		if w := getAvatar(s, target, ""); w.Code != status {
+			t.Errorf("%s: avatarServer wrongly returned %d", target, w.Code)
+		}
+	}
+
+	w := getAvatar(s, "/avatars/abc?s=64", "")
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("avatarServer wrongly returned Content-Type %s", ct)
+	}
+	if w.Header().Get("Cache-Control") == "" {
+		t.Error("avatarServer should set Cache-Control")
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 64 {
+		t.Errorf("avatarServer should resize to 64x64, got %v", b)
+	}
+	if r, g, _, _ := img.At(32, 32).RGBA(); r>>8 != 255 || g != 0 {
+		t.Error("avatarServer should serve the uploaded picture")
+	}
+
+	// conditional request
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("avatarServer should set an ETag")
+	}
+	if w := getAvatar(s, "/avatars/abc?s=64", etag); w.Code != http.StatusNotModified {
+		t.Errorf("avatarServer should return 304 for a matching ETag, got %d", w.Code)
+	}
+
+	// a new upload replaces the cached variant
+	writeTestAvatar(t, file, color.NRGBA{0, 0, 255, 255})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	w = getAvatar(s, "/avatars/abc?s=64", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("avatarServer should serve the new picture, got %d", w.Code)
+	}
+
+	// identicons are stable
+	first := getAvatar(s, "/avatars/nobody?s=32", "")
+	second := getAvatar(newAvatarServer(dir), "/avatars/nobody?s=32", "")
+	if first.Body.String() != second.Body.String() {
+		t.Error("avatarServer should draw the same identicon for the same user")
+	}
+	if other := getAvatar(s, "/avatars/somebody?s=32", ""); other.Body.String() == first.Body.String() {
+		t.Error("avatarServer should draw different identicons for different users")
+	}
+}
+
+func TestIdenticonHandler(t *testing.T) {
+	for target, status := range map[string]int{
+		"/identicons/abc.png":       http.StatusOK,
+		"/identicons/abc.svg?s=32":  http.StatusOK,
+		"/identicons/abc.gif":       http.StatusNotFound,
+		"/identicons/abc":           http.StatusNotFound,
+		"/identicons/a%2Fb.png":     http.StatusNotFound,
+		"/identicons/abc.png?s=512": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		identiconHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != status {
+			t.Errorf("%s: identiconHandler wrongly returned %d", target, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	identiconHandler(w, httptest.NewRequest(http.MethodGet, "/identicons/abc.svg?s=32", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("identiconHandler wrongly returned Content-Type %s", ct)
+	}
+	if w.Body.String() != string(identiconSVG("abc", 32)) {
+		t.Error("identiconHandler should serve the identicon")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/identicons/abc.svg?s=32", nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	identiconHandler(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("identiconHandler should return 304 for a matching ETag, got %d", w.Code)
+	}
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jihuichoi/GPB/trace"
+)
+
+var (
+	// ErrBrokerClosed is returned when publishing to a closed broker.
+	ErrBrokerClosed = errors.New("chat: broker closed")
+	// ErrNotDelivered is sent to clients whose message the broker did
+	// not take or number in time.
+	ErrNotDelivered = errors.New("chat: message not delivered, please send it again")
+)
+
+const (
+	// brokerBufferSize is how many messages a subscription can hold.
+	brokerBufferSize = 256
+	// pendingTimeout is how long a room waits for the broker to send
+	// back a message it published.
+	pendingTimeout = 30 * time.Second
+	// frameWindow is how far the time of a signed frame may be from the
+	// clock of the server receiving it. Older frames are dropped, so a
+	// frame captured on the network cannot be sent again later; the
+	// clocks of the servers must not be further apart.
+	frameWindow = 30 * time.Second
+)
+
+// Broker carries the messages of rooms between chat servers, so that
+// clients connected to different servers can talk in the same room.
+type Broker interface {
+	// Publish sends msg to every subscriber of the room, the publisher
+	// included. It must not block for long; it is called from room.run.
+	// The broker numbers the messages kept in the history (inHistory)
+	// with the next Seq of the room, so every server stores them with
+	// the same Seq in the same order. The Seq msg has, if any, is the
+	// last one the publisher knows, and numbering goes on after it, e.g.
+	// when the broker restarted.
+	Publish(room string, msg *message) error
+	// Subscribe returns the messages published to the room and a
+	// function to cancel the subscription.
+	Subscribe(room string) (<-chan *message, func())
+}
+
+// InProcessBroker is a Broker within a single process. With a single
+// room per name in the process it behaves as if there was no broker.
+type InProcessBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *message]bool
+	// seqs are the last sequence numbers of the rooms.
+	seqs map[string]int64
+}
+
+// NewInProcessBroker makes an InProcessBroker without subscribers.
+func NewInProcessBroker() *InProcessBroker {
+	return &InProcessBroker{subs: make(map[string]map[chan *message]bool), seqs: make(map[string]int64)}
+}
+
+// Publish is ...
+func (b *InProcessBroker) Publish(room string, msg *message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	numbered := *msg
+	numbered.Seq = 0
+	if msg.inHistory() {
+		if msg.Seq > b.seqs[room] {
+			b.seqs[room] = msg.Seq
+		}
+		b.seqs[room]++
+		numbered.Seq = b.seqs[room]
+	}
+	// 번호를 매기고 보내는 동안 잠가두므로 모든 구독자가 같은 순서로 받는다.
+	for sub := range b.subs[room] {
+		copied := numbered
+		select {
+		case sub <- &copied:
+		default: // 구독자가 느리면 버린다. 룸이 막히면 안 된다.
+		}
+	}
+	return nil
+}
+
+// Subscribe is ...
+func (b *InProcessBroker) Subscribe(room string) (<-chan *message, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := make(chan *message, brokerBufferSize)
+	if b.subs[room] == nil {
+		b.subs[room] = make(map[chan *message]bool)
+	}
+	b.subs[room][sub] = true
+	var once sync.Once
+	return sub, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs[room], sub)
+			if len(b.subs[room]) == 0 {
+				delete(b.subs, room)
+			}
+			close(sub)
+		})
+	}
+}
+
+// brokerFrame is a line of the TCP broker protocol.
+// ops: "sub" and "unsub" from clients, "pub" in both directions.
+// With a shared secret every frame carries the HMAC-SHA256 of its op,
+// room, time, nonce and message in MAC, so only servers knowing the
+// secret can publish messages (and moderation) to the rooms of the
+// others, and a frameGuard drops frames sent again.
+type brokerFrame struct {
+	Op   string          `json:"op"`
+	Room string          `json:"room"`
+	Msg  json.RawMessage `json:"msg,omitempty"`
+	// Time is when the frame was made, in Unix nanoseconds, and Nonce
+	// is random; both only with a secret.
+	Time  int64  `json:"time,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	MAC   string `json:"mac,omitempty"`
+}
+
+// newBrokerFrame makes a frame carrying msg, if any, signed with secret.
+func newBrokerFrame(op, room string, msg *message, secret []byte) (*brokerFrame, error) {
+	frame := &brokerFrame{Op: op, Room: room}
+	if len(secret) != 0 {
+		frame.Time = time.Now().UnixNano()
+		frame.Nonce = newMessageID()
+	}
+	if msg != nil {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		frame.Msg = data
+	}
+	frame.MAC = frame.mac(secret)
+	return frame, nil
+}
+
+// mac computes the MAC of the frame, or "" without a secret.
+func (f *brokerFrame) mac(secret []byte) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s\n%s\n%d\n%s\n", f.Op, f.Room, f.Time, f.Nonce)
+	h.Write(f.Msg)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verify reports whether the frame was signed with secret.
+func (f *brokerFrame) verify(secret []byte) bool {
+	return hmac.Equal([]byte(f.MAC), []byte(f.mac(secret)))
+}
+
+// frameGuard checks the frames a connection receives: with a secret
+// they must be signed with it, made within frameWindow and not seen
+// before, so frames captured on the network cannot be replayed.
+type frameGuard struct {
+	secret []byte
+
+	mu sync.Mutex
+	// nonces maps the nonces of the frames received within frameWindow
+	// to the time of their frame.
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+func newFrameGuard(secret []byte) *frameGuard {
+	return &frameGuard{secret: secret, nonces: make(map[string]time.Time)}
+}
+
+// accept reports whether the frame may be used. The guard is shared by
+// all connections, so a frame cannot be replayed on another one either.
+func (g *frameGuard) accept(f *brokerFrame, now time.Time) bool {
+	if !f.verify(g.secret) {
+		return false
+	}
+	if len(g.secret) == 0 {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	when := time.Unix(0, f.Time)
+	if when.Before(now.Add(-frameWindow)) || when.After(now.Add(frameWindow)) || f.Nonce == "" {
+		return false
+	}
+	if now.Sub(g.pruned) > frameWindow {
+		// 창을 벗어난 nonce 는 시간으로 이미 걸러진다.
+		for nonce, t := range g.nonces {
+			if t.Before(now.Add(-frameWindow)) {
+				delete(g.nonces, nonce)
+			}
+		}
+		g.pruned = now
+	}
+	if _, ok := g.nonces[f.Nonce]; ok {
+		return false
+	}
+	g.nonces[f.Nonce] = when
+	return true
+}
+
+// message decodes the message of a "pub" frame.
+func (f *brokerFrame) message() (*message, error) {
+	if len(f.Msg) == 0 {
+		return nil, errors.New("chat: broker frame without a message")
+	}
+	var msg message
+	if err := json.Unmarshal(f.Msg, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// BrokerServer relays published messages between TCPBroker clients.
+// It keeps nothing; a message is only delivered to current subscribers.
+// Clients are trusted with the rooms of every server, so without a
+// secret it must only be reachable from a trusted network.
+type BrokerServer struct {
+	InProcessBroker
+	Tracer trace.Tracer
+
+	secret []byte
+	guard  *frameGuard
+
+	mu    sync.Mutex
+	l     net.Listener
+	conns map[net.Conn]bool
+}
+
+// NewBrokerServer makes a BrokerServer; call Serve to start it. If
+// secret is not empty, clients must sign their frames with it and
+// connections sending anything else are dropped.
+func NewBrokerServer(secret []byte) *BrokerServer {
+	return &BrokerServer{
+		InProcessBroker: *NewInProcessBroker(),
+		Tracer:          trace.Off(),
+		secret:          secret,
+		guard:           newFrameGuard(secret),
+		conns:           make(map[net.Conn]bool),
+	}
+}
+
+// Serve accepts broker clients on l until Close is called.
+func (s *BrokerServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.l = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server and disconnects all clients.
+func (s *BrokerServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Close()
+}
+
+func (s *BrokerServer) serveConn(conn net.Conn) {
+	s.Tracer.Trace("Broker client connected: ", conn.RemoteAddr())
+	out := make(chan *brokerFrame, brokerBufferSize)
+	cancels := make(map[string]func())
+	var forwarders sync.WaitGroup
+	defer func() {
+		// 구독을 끊으면 sub 채널이 닫히고 forwarder 가 끝난다. 그 뒤에 out 을 닫는다.
+		for _, cancel := range cancels {
+			cancel()
+		}
+		forwarders.Wait()
+		close(out)
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.Tracer.Trace("Broker client left: ", conn.RemoteAddr())
+	}()
+	go func() {
+		enc := json.NewEncoder(conn)
+		for frame := range out {
+			if err := enc.Encode(frame); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var frame brokerFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return
+		}
+		if !s.guard.accept(&frame, time.Now()) {
+			s.Tracer.Trace("Broker client sent a frame with a bad MAC, an old one or one sent before: ", conn.RemoteAddr())
+			return
+		}
+		switch frame.Op {
+		case "sub":
+			if _, ok := cancels[frame.Room]; ok {
+				continue
+			}
+			sub, cancel := s.Subscribe(frame.Room)
+			cancels[frame.Room] = cancel
+			forwarders.Add(1)
+			go func(room string) {
+				defer forwarders.Done()
+				for msg := range sub {
+					frame, err := newBrokerFrame("pub", room, msg, s.secret)
+					if err != nil {
+						continue
+					}
+					select {
+					case out <- frame:
+					default: // 느린 클라이언트
+					}
+				}
+			}(frame.Room)
+		case "unsub":
+			if cancel, ok := cancels[frame.Room]; ok {
+				cancel()
+				delete(cancels, frame.Room)
+			}
+		case "pub":
+			if msg, err := frame.message(); err == nil {
+				s.Publish(frame.Room, msg)
+			}
+		}
+	}
+}
+
+// TCPBroker is a Broker talking to a BrokerServer over TCP. It
+// reconnects and subscribes again when the connection drops; messages
+// published while disconnected are lost.
+type TCPBroker struct {
+	addr   string
+	secret []byte
+	guard  *frameGuard
+	tracer trace.Tracer
+
+	mu   sync.Mutex
+	conn net.Conn
+	subs map[string]map[chan *message]bool
+	// writeMu serializes writes to conn.
+	writeMu sync.Mutex
+	out     chan *brokerFrame
+	closed  bool
+	done    chan struct{}
+}
+
+// DialBroker connects to the BrokerServer at addr. secret must be the
+// secret of the server; frames not signed with it, old ones and ones
+// received before are ignored.
+func DialBroker(addr string, secret []byte, tracer trace.Tracer) (*TCPBroker, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &TCPBroker{
+		addr:   addr,
+		secret: secret,
+		guard:  newFrameGuard(secret),
+		tracer: tracer,
+		conn:   conn,
+		subs:   make(map[string]map[chan *message]bool),
+		out:    make(chan *brokerFrame, brokerBufferSize),
+		done:   make(chan struct{}),
+	}
+	go b.writeLoop()
+	go b.readLoop(conn)
+	return b, nil
+}
+
+// Publish is ...
+func (b *TCPBroker) Publish(room string, msg *message) error {
+	// 룸이 Publish 뒤에 msg 를 바꿀 수 있으므로 (Seq 등) 여기서 인코딩한다.
+	frame, err := newBrokerFrame("pub", room, msg, b.secret)
+	if err != nil {
+		return err
+	}
+	return b.send(frame)
+}
+
+// send queues a frame without blocking.
+func (b *TCPBroker) send(frame *brokerFrame) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	select {
+	case b.out <- frame:
+		return nil
+	default:
+		return errors.New("chat: broker queue full")
+	}
+}
+
+// Subscribe is ...
+func (b *TCPBroker) Subscribe(room string) (<-chan *message, func()) {
+	sub := make(chan *message, brokerBufferSize)
+	b.mu.Lock()
+	first := b.subs[room] == nil
+	if first {
+		b.subs[room] = make(map[chan *message]bool)
+	}
+	b.subs[room][sub] = true
+	b.mu.Unlock()
+	if first {
+		frame, _ := newBrokerFrame("sub", room, nil, b.secret)
+		b.send(frame)
+	}
+	var once sync.Once
+	return sub, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[room], sub)
+			last := len(b.subs[room]) == 0
+			if last {
+				delete(b.subs, room)
+			}
+			close(sub)
+			b.mu.Unlock()
+			if last {
+				frame, _ := newBrokerFrame("unsub", room, nil, b.secret)
+				b.send(frame)
+			}
+		})
+	}
+}
+
+// Close disconnects from the broker server.
+func (b *TCPBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	return b.conn.Close()
+}
+
+func (b *TCPBroker) currentConn() net.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn
+}
+
+func (b *TCPBroker) writeLoop() {
+	for {
+		select {
+		case frame := <-b.out:
+			conn := b.currentConn()
+			b.writeMu.Lock()
+			err := json.NewEncoder(conn).Encode(frame)
+			b.writeMu.Unlock()
+			if err != nil {
+				b.tracer.Trace("Broker write failed: ", err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *TCPBroker) readLoop(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var frame brokerFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil || frame.Op != "pub" {
+			continue
+		}
+		if !b.guard.accept(&frame, time.Now()) {
+			b.tracer.Trace("Broker sent a frame with a bad MAC, an old one or one sent before")
+			continue
+		}
+		msg, err := frame.message()
+		if err != nil {
+			continue
+		}
+		b.mu.Lock()
+		for sub := range b.subs[frame.Room] {
+			copied := *msg
+			select {
+			case sub <- &copied:
+			default:
+			}
+		}
+		b.mu.Unlock()
+	}
+	b.reconnect()
+}
+
+// reconnect dials the server again with backoff and restores the
+// subscriptions.
+func (b *TCPBroker) reconnect() {
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+		conn, err := net.Dial("tcp", b.addr)
+		if err != nil {
+			b.tracer.Trace("Broker reconnect failed: ", err)
+			if backoff < 10*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			conn.Close()
+			return
+		}
+		b.conn.Close()
+		b.conn = conn
+		rooms := make([]string, 0, len(b.subs))
+		for room := range b.subs {
+			rooms = append(rooms, room)
+		}
+		b.mu.Unlock()
+		b.writeMu.Lock()
+		enc := json.NewEncoder(conn)
+		for _, room := range rooms {
+			frame, _ := newBrokerFrame("sub", room, nil, b.secret)
+			enc.Encode(frame)
+		}
+		b.writeMu.Unlock()
+		b.tracer.Trace("Broker reconnected")
+		go b.readLoop(conn)
+		return
+	}
+}
+
+// seenIDs remembers the last IDs it was given, to drop duplicates.
+type seenIDs struct {
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+func newSeenIDs(size int) *seenIDs {
+	return &seenIDs{ids: make(map[string]bool, size), order: make([]string, size)}
+}
+
+// remove forgets id, e.g. of a message that was not delivered after
+// all, so it can be sent again.
+func (s *seenIDs) remove(id string) {
+	delete(s.ids, id)
+}
+
+// add records id and reports whether it was new.
+func (s *seenIDs) add(id string) bool {
+	if s.ids[id] {
+		return false
+	}
+	// 가장 오래된 ID 를 밀어낸다.
+	delete(s.ids, s.order[s.next])
+	s.order[s.next] = id
+	s.next = (s.next + 1) % len(s.order)
+	s.ids[id] = true
+	return true
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRoomsShareBroker(t *testing.T) {
+	broker := NewInProcessBroker()
+	// two nodes with the same room
+	a, b := newRoom(), newRoom()
+	a.name, b.name = "test", "test"
+	a.node, b.node = "a", "b"
+	a.broker, b.broker = broker, broker
+	go a.run()
+	go b.run()
+	defer close(a.quit)
+	defer close(b.quit)
+
+	onA := newTestClient(t, a)
+	onB := newTestClient(t, b)
+	a.join <- onA
+	b.join <- onB
+	waitForRoom(a)
+	waitForRoom(b)
+
+	a.forward <- &message{Type: typeChat, Message: "hello"}
+	if msgs := receive(t, onB, 1); msgs[0].Message != "hello" || msgs[0].Origin != "a" {
+		t.Errorf("client on node b should get the message from node a, got %+v", msgs[0])
+	}
+	if msgs := receive(t, onA, 1); msgs[0].Message != "hello" {
+		t.Errorf("client on node a should get its own message, got %+v", msgs[0])
+	}
+
+	// a duplicate of an already seen message is dropped
+	dup := &message{Type: typeChat, ID: "same", Origin: "c", Message: "once"}
+	broker.Publish("test", dup)
+	broker.Publish("test", dup)
+	receive(t, onA, 1)
+	receive(t, onB, 1)
+	waitForRoom(a)
+	waitForRoom(b)
+	if len(onA.send) != 0 || len(onB.send) != 0 {
+		t.Error("duplicate message should be dropped")
+	}
+	if msgs, _ := lastMessages(b.store, "test", 10); len(msgs) != 2 {
+		t.Errorf("node b should store remote messages, got %d", len(msgs))
+	}
+}
+
+func TestTCPBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("shared")
+	server := NewBrokerServer(secret)
+	go server.Serve(l)
+	defer server.Close()
+
+	one, err := DialBroker(l.Addr().String(), secret, server.Tracer)
+	if err != nil {
+		t.Fatalf("DialBroker should not return an error: %s", err)
+	}
+	defer one.Close()
+	two, _ := DialBroker(l.Addr().String(), secret, server.Tracer)
+	defer two.Close()
+	// 비밀을 모르는 클라이언트는 아무것도 보낼 수 없다.
+	intruder, _ := DialBroker(l.Addr().String(), []byte("guess"), server.Tracer)
+	defer intruder.Close()
+
+	sub, cancel := two.Subscribe("test")
+	defer cancel()
+	// the subscription has to reach the server before publishing
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		intruder.Publish("test", &message{ID: "x", Type: typeModerate, Message: "ban"})
+		one.Publish("test", &message{ID: "1", Message: "hello"})
+		select {
+		case msg := <-sub:
+			if msg.ID != "1" {
+				t.Errorf("subscriber wrongly received %+v", msg)
+			}
+			// 룸은 Publish 뒤에도 메세지를 바꾼다. (store.Append 의 Seq)
+			later := &message{ID: "2", Message: "again"}
+			one.Publish("test", later)
+			later.Seq = 7
+			for msg := range sub {
+				if msg.ID == "x" {
+					t.Errorf("a frame signed with the wrong secret should be dropped, got %+v", msg)
+				}
+				if msg.ID != "2" {
+					continue // 앞에서 여러번 보낸 hello
+				}
+				// broker 가 번호를 매긴다. Publish 뒤에 바꾼 7 이 아니다.
+				if msg.Seq == 0 || msg.Seq == 7 {
+					t.Errorf("the broker should number the message and not see changes after Publish, got %+v", msg)
+				}
+				break
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber received nothing")
+		}
+	}
+}
+
+// waitForRecords waits until the store has n records of the room and
+// returns them.
+func waitForRecords(t *testing.T, store MessageStore, room string, n int) []*message {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		records, _ := store.Since(room, 0, n+10)
+		if len(records) >= n {
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("store has %d of %d records", len(records), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBrokerFrameReplay(t *testing.T) {
+	secret := []byte("shared")
+	guard := newFrameGuard(secret)
+	now := time.Now()
+	frame, _ := newBrokerFrame("pub", "test", &message{ID: "1", Type: typeModerate, Message: "ban"}, secret)
+	if !guard.accept(frame, now) {
+		t.Fatal("a fresh signed frame should be accepted")
+	}
+	if guard.accept(frame, now) {
+		t.Error("a frame sent again should be dropped")
+	}
+	if guard.accept(frame, now.Add(time.Hour)) {
+		t.Error("an old frame should be dropped after its nonce was forgotten")
+	}
+	stale, _ := newBrokerFrame("pub", "test", &message{ID: "2"}, secret)
+	stale.Time = now.Add(-2 * frameWindow).UnixNano()
+	if guard.accept(stale, now) {
+		t.Error("a frame with a changed time should fail the MAC")
+	}
+	stale.MAC = stale.mac(secret)
+	if guard.accept(stale, now) {
+		t.Error("a frame older than the window should be dropped")
+	}
+
+	// 서버는 다시 보낸 프레임을 받으면 연결을 끊는다.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewBrokerServer(secret)
+	go server.Serve(l)
+	defer server.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	replayed, _ := newBrokerFrame("pub", "test", &message{ID: "3"}, secret)
+	line, _ := json.Marshal(replayed)
+	line = append(line, '\n')
+	conn.Write(line)
+	conn.Write(line)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("server should drop a client replaying a frame, got %v", err)
+	}
+}
+
+func TestRoomsShareSeq(t *testing.T) {
+	broker := NewInProcessBroker()
+	a := newRoom()
+	a.name, a.node, a.broker = "test", "a", broker
+	go a.run()
+	defer close(a.quit)
+	// node b opens the room after a has history of its own
+	for _, text := range []string{"one", "two"} {
+		a.forward <- &message{Type: typeChat, Message: text}
+	}
+	waitForRecords(t, a.store, "test", 2)
+	b := newRoom()
+	b.name, b.node, b.broker = "test", "b", broker
+	go b.run()
+	defer close(b.quit)
+	waitForRoom(b)
+
+	a.forward <- &message{Type: typeChat, Message: "three"}
+	if records := waitForRecords(t, b.store, "test", 1); records[0].Seq != 3 {
+		t.Fatalf("node b should store the Seq the broker gave, got %d", records[0].Seq)
+	}
+	// 노드 a 에서 두번째 메세지까지 받고 노드 b 로 다시 연결한 브라우저
+	back := newTestClient(t, b)
+	back.since = 2
+	b.join <- back
+	if msgs := receive(t, back, 1); msgs[0].Message != "three" {
+		t.Errorf("client resuming on node b should get the missed message, got %+v", msgs[0])
+	}
+
+	// 두 노드에서 동시에 보내도 번호와 순서가 같다.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			a.forward <- &message{Type: typeChat, Message: "from a"}
+		}
+		close(done)
+	}()
+	for i := 0; i < 20; i++ {
+		b.forward <- &message{Type: typeChat, Message: "from b"}
+	}
+	<-done
+	onA := waitForRecords(t, a.store, "test", 43)
+	onB := waitForRecords(t, b.store, "test", 41)
+	onA = onA[2:]
+	for i := range onB {
+		if onA[i].ID != onB[i].ID || onA[i].Seq != onB[i].Seq || onB[i].Seq != int64(i+3) {
+			t.Fatalf("nodes should store the same records with the same Seq, got %+v and %+v", onA[i], onB[i])
+		}
+	}
+	if records, _ := b.store.Since("test", 30, 100); len(records) != 13 || records[0].Seq != 31 {
+		t.Errorf("resuming on any node should give exactly the missed records, got %d", len(records))
+	}
+}
+
+// downBroker is a Broker that takes nothing.
+type downBroker struct{}
+
+func (downBroker) Publish(room string, msg *message) error { return ErrBrokerClosed }
+func (downBroker) Subscribe(room string) (<-chan *message, func()) {
+	return make(chan *message), func() {}
+}
+
+func TestRoomSequenceFailures(t *testing.T) {
+	// 새로 시작한 broker 는 룸이 아는 마지막 번호부터 이어서 매긴다.
+	r := newRoom()
+	r.name, r.node, r.broker = "test", "a", NewInProcessBroker()
+	for i := 0; i < 5; i++ {
+		r.store.Append("test", &message{Type: typeChat, Message: "old"})
+	}
+	go r.run()
+	defer close(r.quit)
+	r.forward <- &message{Type: typeChat, Message: "new"}
+	if records := waitForRecords(t, r.store, "test", 6); records[5].Seq != 6 {
+		t.Errorf("the broker should number after the history of the room, got %d", records[5].Seq)
+	}
+
+	// broker 가 받지 못하면 보낸 사람이 다시 보낼 수 있다.
+	down := newRoom()
+	down.name, down.node, down.broker = "test", "a", downBroker{}
+	go down.run()
+	defer close(down.quit)
+	sender := newTestUserClient(t, down, "sender")
+	down.join <- sender
+	for i := 0; i < 2; i++ {
+		down.forward <- &message{Type: typeChat, ID: keyedMessageID("sender", "k"), Key: "k", UserID: "sender", Message: "hi", from: sender}
+		if msgs := receive(t, sender, 1); len(msgs) != 1 || msgs[0].Type != typeError || msgs[0].Message != ErrNotDelivered.Error() {
+			t.Errorf("sender should be told the message was not delivered, got %+v", msgs)
+		}
+	}
+}
@@ -1,11 +1,32 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// socketOptions controls the keepalive and limits of client websockets.
+type socketOptions struct {
+	// pingInterval is how often the server pings the browser.
+	pingInterval time.Duration
+	// pongWait is how long to wait for any frame (pongs included)
+	// before the connection is considered dead. Must be > pingInterval.
+	pongWait time.Duration
+	// writeWait is the time allowed to write a frame.
+	writeWait time.Duration
+	// maxMessageSize is the largest frame accepted from the browser.
+	maxMessageSize int64
+}
+
+var defaultSocketOptions = socketOptions{
+	pingInterval:   50 * time.Second,
+	pongWait:       60 * time.Second,
+	writeWait:      10 * time.Second,
+	maxMessageSize: 8 * 1024,
+}
+
 type client struct {
 	// socket is the web socket for this client
 	socket *websocket.Conn
@@ -24,12 +45,39 @@ type client struct {
 	// userData holds information about the user
 	// from room.go userData: objx.MustFromBase64(authCookie.Value),
 	userData map[string]interface{}
+
+	// sessionID is the login session the socket was opened with.
+	sessionID string
+
+	// opts are the keepalive settings of the socket.
+	opts socketOptions
+
+	// since is the sequence number of the last message the browser got
+	// before reconnecting, or 0 for a new connection.
+	since int64
+
+	// closeCode and closeReason are sent in the close frame once the
+	// room closes the send channel. They must be set before that.
+	closeCode   int
+	closeReason string
+}
+
+// userID returns the UniqueID of the user of the client.
+func (c *client) userID() string {
+	id, _ := c.userData["userid"].(string)
+	return id
 }
 
 // 유저의 행동으로서 read 가 아니라, 클라이언트 프로그램의 행동으로서 read
 // 즉, 사용자가 글을 쓰면, 클라이언트 앱이 그 내용을 읽어서(read) room 의 forward chan 으로 전달
 func (c *client) read() {
 	defer c.socket.Close()
+	// 일정 시간 동안 아무 프레임(pong 포함)도 오지 않으면 죽은 연결로 보고 끊는다.
+	c.socket.SetReadLimit(c.opts.maxMessageSize)
+	c.socket.SetReadDeadline(time.Now().Add(c.opts.pongWait))
+	c.socket.SetPongHandler(func(string) error {
+		return c.socket.SetReadDeadline(time.Now().Add(c.opts.pongWait))
+	})
 	for {
 		// _, msg, err := c.socket.ReadMessage()
 		// if err != nil {
@@ -44,34 +92,116 @@ func (c *client) read() {
 		// 	return
 		// }
 		if err := c.socket.ReadJSON(&msg); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				c.closeWith(websocket.CloseUnsupportedData, "invalid message")
+			default:
+				if err == websocket.ErrReadLimit {
+					c.closeWith(websocket.CloseMessageTooBig, "message too big")
+				}
+			}
+			return
+		}
+		if msg == nil {
+			c.closeWith(websocket.CloseUnsupportedData, "invalid message")
 			return
 		}
-		msg.When = time.Now()
-		msg.Name = c.userData["name"].(string)
-		if avatarURL, ok := c.userData["avatar_url"]; ok {
-			msg.AvatarURL = avatarURL.(string)
+		c.socket.SetReadDeadline(time.Now().Add(c.opts.pongWait))
+		// 클라이언트가 보낼 수 없는 타입이거나 형식이 잘못된 경우 보낸 사람에게만 에러를 알린다.
+		if err := msg.validate(); err != nil {
+			c.room.send(errorMessage(c, err))
+			continue
 		}
+		c.stamp(msg)
 		// msg.AvatarURL, _ = c.room.avatar.GetAvatarURL(c)
 		// c.userData["avatar_url"] 이 nil 일 경우 string type 에 대입하면 panic 이 발생하므로 미리 확인해준다.
 		// if avatarURL, ok := c.userData["avatar_url"]; ok {
 		// 	msg.AvatarURL = avatarURL.(string)
 		// }
+		if msg.Type == typeDirect {
+			// 귓속말은 룸을 거치지 않으므로 여기서 확인한다.
+			if err := moderation.allow(c.room.name, msg.UserID); err != nil {
+				c.room.send(errorMessage(c, err))
+				continue
+			}
+			c.sendDirect(msg)
+			continue
+		}
 		c.room.forward <- msg
 	}
 }
 
+// stamp sets what the server decides about a message read from the
+// client: who sent it, its ID, when, and the rich text of its Markdown.
+func (c *client) stamp(msg *message) {
+	msg.UserID = c.userID()
+	// 모든 프레임이 서버가 정한 ID 를 가진다. 클라이언트가 보낸 ID 로 다른 메세지를 흉내낼 수 없다.
+	msg.ID = newMessageID()
+	if msg.Key != "" && (msg.Type == typeChat || msg.Type == typeDirect) {
+		msg.ID = keyedMessageID(msg.UserID, msg.Key)
+	}
+	msg.from = c
+	// 서버가 정하는 값은 클라이언트가 보낸 것을 쓰지 않는다.
+	msg.Origin, msg.Seq, msg.Edited, msg.Reactions = "", 0, nil, nil
+	msg.Replies, msg.LastReply = 0, nil
+	msg.Rich = nil
+	if msg.Type == typeChat || msg.Type == typeDirect || msg.Type == typeEdit {
+		msg.Rich = parseMarkdown(msg.Message)
+	}
+	msg.Room = ""
+	if msg.Type == typeChat {
+		// 언급된 사용자는 룸이 메세지를 받아들인 뒤에 알림을 받는다.
+		msg.mentions = users.mentioned(msg.Rich, msg.UserID)
+	}
+	msg.When = time.Now()
+	msg.Name = c.userData["name"].(string)
+	if avatarURL, ok := c.userData["avatar_url"]; ok {
+		msg.AvatarURL = avatarURL.(string)
+	}
+}
+
 // 마찬가지로, 사용자가 글을 작성하는 것이 아니라,
 // 클라이언트 앱이 forward chan 에서 각 클라이언트의 send 채널로 메세지를 전달하면
 // send 채널에 있는 메세지를 화면에 write 한다는 의미
 func (c *client) write() {
-	defer c.socket.Close()
-	for msg := range c.send {
-		// err := c.socket.WriteMessage(websocket.TextMessage, msg)
+	ticker := time.NewTicker(c.opts.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.socket.Close()
+	}()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				// room 이 send 채널을 닫았다. (leave, shutdown)
+				if c.closeCode == 0 {
+					c.closeCode = websocket.CloseNormalClosure
+				}
+				c.closeWith(c.closeCode, c.closeReason)
+				return
+			}
+			// err := c.socket.WriteMessage(websocket.TextMessage, msg)
 
-		// ch2: json 형식으로 변경
-		err := c.socket.WriteJSON(msg)
-		if err != nil {
-			return
+			// ch2: json 형식으로 변경
+			c.socket.SetWriteDeadline(time.Now().Add(c.opts.writeWait))
+			err := c.socket.WriteJSON(msg)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.opts.writeWait)); err != nil {
+				return
+			}
 		}
 	}
 }
+
+// closeWith sends a close frame with the given code and reason and
+// closes the socket once the browser answered or writeWait has passed.
+// It may be called from any goroutine, but can block up to writeWait.
+func (c *client) closeWith(code int, reason string) {
+	c.socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(c.opts.writeWait))
+	// 브라우저가 close 프레임으로 답하면 read() 가 끝나면서 소켓을 닫는다.
+	// 답이 없는 경우를 위해 일정 시간 후 강제로 닫는다.
+	time.AfterFunc(c.opts.writeWait, func() { c.socket.Close() })
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+	"github.com/stretchr/gomniauth/providers/facebook"
+	"github.com/stretchr/gomniauth/providers/github"
+	"github.com/stretchr/gomniauth/providers/google"
+)
+
+// providerConstructors are the OAuth providers that can be configured.
+var providerConstructors = map[string]func(clientID, secret, callbackURL string) gomniauthcommon.Provider{
+	"facebook": func(id, secret, callback string) gomniauthcommon.Provider { return facebook.New(id, secret, callback) },
+	"github":   func(id, secret, callback string) gomniauthcommon.Provider { return github.New(id, secret, callback) },
+	"google":   func(id, secret, callback string) gomniauthcommon.Provider { return google.New(id, secret, callback) },
+}
+
+// avatarStrategies make the Avatar implementations the chain can be
+// built from, with their options.
+var avatarStrategies = map[string]func(avatarConfig) Avatar{
+	"filesystem": func(c avatarConfig) Avatar { return FileSystemAvatar(c.Filesystem) },
+	"auth":       func(avatarConfig) Avatar { return UseAuthAvatar },
+	"gravatar":   func(c avatarConfig) Avatar { return GravatarAvatar(c.Gravatar) },
+	"fallback":   func(c avatarConfig) Avatar { return FallbackAvatar(c.Fallback) },
+	"identicon":  func(c avatarConfig) Avatar { return IdenticonAvatar(c.Identicon) },
+}
+
+// duration is a time.Duration written as "10s" in config files,
+// environment variables and flags.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Set implements flag.Value.
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// stringList is a comma separated list in environment variables and flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value.
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// providerNamePattern is what a provider name must look like to be used
+// in /auth/{action}/{provider}.
+var providerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// providerConfig configures an OAuth provider.
+type providerConfig struct {
+	Enabled  bool   `json:"enabled"`
+	ClientID string `json:"client_id"`
+	Secret   string `json:"secret"`
+	// Issuer makes this a generic OpenID Connect provider of any name,
+	// configured by discovery from the issuer URL.
+	Issuer string `json:"issuer"`
+}
+
+// pathsConfig holds the directories the server reads from.
+type pathsConfig struct {
+	Templates string `json:"templates"`
+	Avatars   string `json:"avatars"`
+	Assets    string `json:"assets"`
+}
+
+// avatarConfig holds the options of each avatar strategy.
+type avatarConfig struct {
+	Filesystem struct {
+		Dir       string `json:"dir"`
+		URLPrefix string `json:"url_prefix"`
+	} `json:"filesystem"`
+	Gravatar struct {
+		Default string `json:"default"`
+		Size    int    `json:"size"`
+		Rating  string `json:"rating"`
+	} `json:"gravatar"`
+	Fallback struct {
+		URL string `json:"url"`
+	} `json:"fallback"`
+	Identicon struct {
+		URLPrefix string `json:"url_prefix"`
+		Format    string `json:"format"`
+	} `json:"identicon"`
+	// Debug traces which strategy was used for every login.
+	Debug bool `json:"debug"`
+}
+
+// localConfig configures the built-in username/password accounts.
+type localConfig struct {
+	Enabled bool `json:"enabled"`
+	// Store is where accounts are kept: memory, file or bolt.
+	Store             string `json:"store"`
+	Path              string `json:"path"`
+	BcryptCost        int    `json:"bcrypt_cost"`
+	AllowRegistration bool   `json:"allow_registration"`
+}
+
+// moderationConfig configures room roles, bans and the audit log.
+type moderationConfig struct {
+	// Owners are the UniqueIDs of users who own every room.
+	Owners stringList `json:"owners"`
+	// DefaultRole is the role of everyone else: member or guest.
+	DefaultRole string `json:"default_role"`
+	// File keeps roles, bans and mutes (in memory if empty).
+	File     string `json:"file"`
+	AuditLog string `json:"audit_log"`
+}
+
+// config is the configuration of the chat server. It is loaded from
+// defaults, then a JSON file (-config), then CHAT_* environment
+// variables, then command line flags, each overriding the one before.
+// See config.example.json.
+type config struct {
+	Host      string `json:"host"`
+	PublicURL string `json:"public_url"`
+
+	SecurityKey      string   `json:"security_key"`
+	CookieKey        string   `json:"cookie_key"`
+	EncryptCookie    bool     `json:"encrypt_cookie"`
+	SecureCookies    bool     `json:"secure_cookies"`
+	CookieMaxAge     duration `json:"cookie_max_age"`
+	IdleTimeout      duration `json:"idle_timeout"`
+	SessionFile      string   `json:"session_file"`
+	NotificationFile string   `json:"notification_file"`
+	UserFile         string   `json:"user_file"`
+
+	HistoryDir      string   `json:"history_dir"`
+	SlowPolicy      string   `json:"slow_policy"`
+	PingInterval    duration `json:"ping_interval"`
+	PongWait        duration `json:"pong_wait"`
+	WriteWait       duration `json:"write_wait"`
+	MaxMessageSize  int64    `json:"max_message_size"`
+	EditWindow      duration `json:"edit_window"`
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+
+	Node         string `json:"node"`
+	Broker       string `json:"broker"`
+	BrokerListen string `json:"broker_listen"`
+	BrokerSecret string `json:"broker_secret"`
+
+	Paths       pathsConfig                `json:"paths"`
+	Providers   map[string]*providerConfig `json:"providers"`
+	AvatarChain stringList                 `json:"avatar_chain"`
+	Avatars     avatarConfig               `json:"avatars"`
+	Local       localConfig                `json:"local"`
+	Moderation  moderationConfig           `json:"moderation"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Host:            ":8080",
+		PublicURL:       "http://localhost:8080",
+		CookieMaxAge:    duration{24 * time.Hour},
+		IdleTimeout:     duration{2 * time.Hour},
+		SlowPolicy:      "drop-oldest",
+		PingInterval:    duration{defaultSocketOptions.pingInterval},
+		PongWait:        duration{defaultSocketOptions.pongWait},
+		WriteWait:       duration{defaultSocketOptions.writeWait},
+		MaxMessageSize:  defaultSocketOptions.maxMessageSize,
+		EditWindow:      duration{defaultEditWindow},
+		ShutdownTimeout: duration{10 * time.Second},
+		Paths: pathsConfig{
+			Templates: "templates",
+			Avatars:   "avatars",
+			Assets:    "assets",
+		},
+		Providers:   make(map[string]*providerConfig),
+		AvatarChain: stringList{"filesystem", "auth", "gravatar"},
+		Local: localConfig{
+			Store:             "memory",
+			BcryptCost:        bcrypt.DefaultCost,
+			AllowRegistration: true,
+		},
+		Moderation: moderationConfig{
+			DefaultRole: "member",
+		},
+	}
+}
+
+// bindFlags defines a flag for every setting on fs.
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	// 채팅 사이트 주소가 하드코딩됨 (localhost:8080)
+	// 이를 커맨드라인에서 -addr 라는 플래그로 처리하도록 경 ./chat -addr=":3000" 이라는 형식으로 실행이 가능해짐
+	fs.StringVar(&c.Host, "host", c.Host, "The addr of the application")
+	fs.StringVar(&c.PublicURL, "publicurl", c.PublicURL, "The URL users reach the application at, used for OAuth callbacks")
+	fs.StringVar(&c.CookieKey, "key", c.CookieKey, "The secret used to sign auth cookies (random if empty)")
+	fs.BoolVar(&c.EncryptCookie, "encrypt", c.EncryptCookie, "Encrypt the auth cookie as well as signing it")
+	fs.Var(&c.CookieMaxAge, "maxage", "How long an auth cookie stays valid")
+	fs.BoolVar(&c.SecureCookies, "secure", c.SecureCookies, "Only send cookies over HTTPS")
+	fs.Var(&c.IdleTimeout, "idle", "How long an unused session stays valid")
+	fs.StringVar(&c.SessionFile, "sessions", c.SessionFile, "File to keep sessions in (in memory if empty)")
+	fs.StringVar(&c.NotificationFile, "notifications", c.NotificationFile, "File to keep the notification inboxes of users in (in memory if empty)")
+	fs.StringVar(&c.UserFile, "users", c.UserFile, "File to keep the users the server knows in, so direct messages reach them after a restart (in memory if empty)")
+	fs.StringVar(&c.SlowPolicy, "slow", c.SlowPolicy, "What to do with clients that cannot keep up: drop-oldest, drop-newest or disconnect, optionally followed by per room overrides (e.g. drop-oldest,lobby=disconnect)")
+	fs.Var(&c.PingInterval, "ping", "How often to ping websocket clients")
+	fs.Var(&c.PongWait, "pongwait", "How long to wait for a websocket client to answer before dropping it")
+	fs.Var(&c.WriteWait, "writewait", "The time allowed to write to a websocket client")
+	fs.Int64Var(&c.MaxMessageSize, "maxmsg", c.MaxMessageSize, "The largest message accepted from a websocket client, in bytes")
+	fs.Var(&c.EditWindow, "editwindow", "How long authors can edit or delete their messages (0 for no limit)")
+	fs.Var(&c.ShutdownTimeout, "shutdown", "How long to wait for clients to leave when shutting down")
+	fs.StringVar(&c.Node, "node", c.Node, "The name of this server among others sharing a broker (random if empty)")
+	fs.StringVar(&c.Broker, "broker", c.Broker, "Address of the broker server to share rooms with other servers")
+	fs.StringVar(&c.BrokerListen, "brokerlisten", c.BrokerListen, "Run a broker server on this address (loopback only without -brokersecret; the broker trusts its clients with every room)")
+	fs.StringVar(&c.BrokerSecret, "brokersecret", c.BrokerSecret, "The secret shared by the broker server and its clients to sign broker frames")
+	fs.StringVar(&c.HistoryDir, "history", c.HistoryDir, "Directory to keep the chat history in (in memory if empty)")
+	fs.Var(&c.AvatarChain, "avatars", "Comma separated avatar strategies to try in order: filesystem, auth, gravatar, fallback, identicon")
+	fs.BoolVar(&c.Avatars.Debug, "debugavatars", c.Avatars.Debug, "Log which avatar strategy was used for every login")
+	fs.BoolVar(&c.Local.Enabled, "local", c.Local.Enabled, "Let users sign in with a local username and password")
+	fs.StringVar(&c.Local.Store, "localstore", c.Local.Store, "Where to keep local accounts: memory, file or bolt")
+	fs.StringVar(&c.Local.Path, "localpath", c.Local.Path, "File of the local account store")
+	fs.Var(&c.Moderation.Owners, "owners", "Comma separated UniqueIDs of users who own every room")
+	fs.StringVar(&c.Moderation.DefaultRole, "defaultrole", c.Moderation.DefaultRole, "Role of users given none in a room: member or guest")
+	fs.StringVar(&c.Moderation.File, "moderation", c.Moderation.File, "File to keep room roles, bans and mutes in (in memory if empty)")
+	fs.StringVar(&c.Moderation.AuditLog, "audit", c.Moderation.AuditLog, "File to append moderation audit entries to (the log if empty)")
+}
+
+// loadConfig builds the configuration from args (without the program
+// name), the file given by -config and the environment, and validates it.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	configFile := fs.String("config", "", "JSON configuration file")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	// 플래그가 파일과 환경변수보다 우선하도록, 지정된 플래그를 기억했다가 마지막에 다시 적용한다.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			set[f.Name] = f.Value.String()
+		}
+	})
+	*cfg = *defaultConfig()
+	if *configFile != "" {
+		f, err := os.Open(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", *configFile, err)
+		}
+	}
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides settings from CHAT_{JSON NAME} environment
+// variables, e.g. CHAT_PUBLIC_URL, CHAT_PATHS_AVATARS and
+// CHAT_PROVIDERS_GITHUB_CLIENT_ID.
+func (c *config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	if err := applyEnvStruct(reflect.ValueOf(c).Elem(), "CHAT_", lookupEnv); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for name := range providerConstructors {
+		names[name] = true
+	}
+	for name := range c.Providers {
+		names[name] = true
+	}
+	for name := range names {
+		p := c.Providers[name]
+		if p == nil {
+			p = &providerConfig{}
+		}
+		prefix := "CHAT_PROVIDERS_" + strings.ToUpper(name) + "_"
+		if err := applyEnvStruct(reflect.ValueOf(p).Elem(), prefix, lookupEnv); err != nil {
+			return err
+		}
+		if *p != (providerConfig{}) {
+			c.Providers[name] = p
+		}
+	}
+	return nil
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + strings.ToUpper(t.Field(i).Tag.Get("json"))
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeOf(duration{}) {
+			if err := applyEnvStruct(field, name+"_", lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch p := field.Addr().Interface().(type) {
+		case flag.Value:
+			err = p.Set(value)
+		case *string:
+			*p = value
+		case *bool:
+			*p, err = strconv.ParseBool(value)
+		case *int64:
+			*p, err = strconv.ParseInt(value, 10, 64)
+		case *int:
+			*p, err = strconv.Atoi(value)
+		default:
+			continue // providers 는 applyEnv 에서 따로 처리
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the settings the server cannot start without.
+func (c *config) validate() error {
+	var problems []string
+	if c.Host == "" {
+		problems = append(problems, "host is required")
+	}
+	if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("public_url %q must be an absolute http(s) URL", c.PublicURL))
+	}
+	if c.SecurityKey == "" {
+		problems = append(problems, "security_key is required")
+	}
+	if len(c.enabledProviders()) == 0 && !c.Local.Enabled {
+		problems = append(problems, "at least one provider or local accounts must be enabled")
+	}
+	if c.Local.Enabled {
+		switch c.Local.Store {
+		case "memory":
+		case "file", "bolt":
+			if c.Local.Path == "" {
+				problems = append(problems, fmt.Sprintf("local.path is required for the %s store", c.Local.Store))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("unknown local account store %q", c.Local.Store))
+		}
+		if c.Local.BcryptCost < bcrypt.MinCost || c.Local.BcryptCost > bcrypt.MaxCost {
+			problems = append(problems, fmt.Sprintf("local.bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+		}
+	}
+	for name, p := range c.Providers {
+		if p.Issuer != "" {
+			if u, err := url.Parse(p.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("provider %s: issuer %q must be an absolute http(s) URL", name, p.Issuer))
+			}
+			if !providerNamePattern.MatchString(name) {
+				problems = append(problems, fmt.Sprintf("provider name %q must be letters, digits, '_' or '-'", name))
+			}
+		} else if _, ok := providerConstructors[name]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown provider %q", name))
+			continue
+		}
+		if p.Enabled && (p.ClientID == "" || p.Secret == "") {
+			problems = append(problems, fmt.Sprintf("provider %s needs client_id and secret", name))
+		}
+	}
+	if len(c.AvatarChain) == 0 {
+		problems = append(problems, "avatar_chain must not be empty")
+	}
+	for _, name := range c.AvatarChain {
+		if _, ok := avatarStrategies[name]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown avatar strategy %q", name))
+		}
+		if name == "fallback" && c.Avatars.Fallback.URL == "" {
+			problems = append(problems, "avatars.fallback.url is required for the fallback strategy")
+		}
+	}
+	if f := c.Avatars.Identicon.Format; f != "" && f != "png" && f != "svg" {
+		problems = append(problems, fmt.Sprintf("unknown identicon format %q", f))
+	}
+	if r := c.Avatars.Gravatar.Rating; r != "" && r != "g" && r != "pg" && r != "r" && r != "x" {
+		problems = append(problems, fmt.Sprintf("unknown gravatar rating %q", r))
+	}
+	if r, err := parseRole(c.Moderation.DefaultRole); err != nil || r > roleMember {
+		problems = append(problems, fmt.Sprintf("moderation.default_role %q must be member or guest", c.Moderation.DefaultRole))
+	}
+	if _, _, err := parseSlowPolicies(c.SlowPolicy); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.PingInterval.Duration <= 0 || c.WriteWait.Duration <= 0 || c.MaxMessageSize <= 0 {
+		problems = append(problems, "ping_interval, write_wait and max_message_size must be positive")
+	}
+	if c.PongWait.Duration <= c.PingInterval.Duration {
+		problems = append(problems, "pong_wait must be longer than ping_interval")
+	}
+	if c.CookieMaxAge.Duration <= 0 || c.IdleTimeout.Duration <= 0 {
+		problems = append(problems, "cookie_max_age and idle_timeout must be positive")
+	}
+	if c.BrokerListen != "" {
+		if host, _, err := net.SplitHostPort(c.BrokerListen); err != nil {
+			problems = append(problems, fmt.Sprintf("broker_listen %q must be host:port", c.BrokerListen))
+		} else if host != "" && !isLoopback(host) && c.BrokerSecret == "" {
+			problems = append(problems, "broker_secret is required to run the broker on a non-loopback address")
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// brokerListenAddr is where the broker server listens. Without a
+// secret anyone who can connect could post as any user and moderate
+// any room, so an address without a host means loopback only.
+func (c *config) brokerListenAddr() string {
+	host, port, err := net.SplitHostPort(c.BrokerListen)
+	if err != nil || host != "" || c.BrokerSecret != "" {
+		return c.BrokerListen
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// isLoopback reports whether host is localhost or a loopback IP.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// enabledProviders returns the names of the enabled providers, sorted.
+func (c *config) enabledProviders() []string {
+	var names []string
+	for name, p := range c.Providers {
+		if p.Enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// callbackURL is where the provider sends the user back after login.
+func (c *config) callbackURL(provider string) string {
+	return strings.TrimRight(c.PublicURL, "/") + "/auth/callback/" + provider
+}
+
+// providers makes the enabled gomniauth providers.
+func (c *config) providers() []gomniauthcommon.Provider {
+	var providers []gomniauthcommon.Provider
+	for _, name := range c.enabledProviders() {
+		p := c.Providers[name]
+		if p.Issuer != "" {
+			continue
+		}
+		providers = append(providers, providerConstructors[name](p.ClientID, p.Secret, c.callbackURL(name)))
+	}
+	return providers
+}
+
+// oidcProviders makes the enabled OpenID Connect providers.
+func (c *config) oidcProviders() map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider)
+	for _, name := range c.enabledProviders() {
+		if p := c.Providers[name]; p.Issuer != "" {
+			providers[name] = newOIDCProvider(name, p.Issuer, p.ClientID, p.Secret, c.callbackURL(name))
+		}
+	}
+	return providers
+}
+
+// userStore opens the store of local accounts.
+func (c *config) userStore() (UserStore, error) {
+	switch c.Local.Store {
+	case "file":
+		return NewFileUserStore(c.Local.Path)
+	case "bolt":
+		return NewBoltUserStore(c.Local.Path)
+	}
+	return NewMemoryUserStore(), nil
+}
+
+// moderationStore opens the roles, bans and mutes of the rooms.
+func (c *config) moderationStore() (*moderationStore, error) {
+	s := newModerationStore()
+	if c.Moderation.File != "" {
+		var err error
+		if s, err = openModerationStore(c.Moderation.File); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range c.Moderation.Owners {
+		s.owners[id] = true
+	}
+	s.defaultRole, _ = parseRole(c.Moderation.DefaultRole) // validate 에서 이미 확인함
+	return s, nil
+}
+
+// avatarChain makes the Avatar to use from AvatarChain.
+func (c *config) avatarChain() Avatar {
+	chain := make(TryAvatars, len(c.AvatarChain))
+	for i, name := range c.AvatarChain {
+		chain[i] = avatarStrategies[name](c.Avatars)
+	}
+	return chain
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(filename, []byte(`{
+		"host": ":9000",
+		"public_url": "https://chat.example.com/",
+		"security_key": "from file",
+		"idle_timeout": "1h",
+		"paths": {"avatars": "/var/avatars"},
+		"providers": {"github": {"enabled": true, "client_id": "id", "secret": "from file"}}
+	}`), 0600)
+	env := map[string]string{
+		"CHAT_SECURITY_KEY":               "from env",
+		"CHAT_HOST":                       ":9001",
+		"CHAT_PROVIDERS_GITHUB_SECRET":    "from env",
+		"CHAT_PROVIDERS_GOOGLE_ENABLED":   "true",
+		"CHAT_PROVIDERS_GOOGLE_CLIENT_ID": "gid",
+		"CHAT_PROVIDERS_GOOGLE_SECRET":    "gsecret",
+		"CHAT_AVATAR_CHAIN":               "auth,gravatar",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cfg, err := loadConfig([]string{"-config", filename, "-host", ":9002"}, lookupEnv)
+	if err != nil {
+		t.Fatalf("loadConfig should not return an error: %s", err)
+	}
+	if cfg.Host != ":9002" {
+		t.Errorf("flags should override env and file, got host %q", cfg.Host)
+	}
+	if cfg.SecurityKey != "from env" || cfg.Providers["github"].Secret != "from env" {
+		t.Errorf("env should override the file, got %q and %q", cfg.SecurityKey, cfg.Providers["github"].Secret)
+	}
+	if cfg.IdleTimeout.Duration != time.Hour || cfg.Paths.Avatars != "/var/avatars" || cfg.Paths.Templates != "templates" {
+		t.Errorf("file should override defaults, got %v, %+v", cfg.IdleTimeout, cfg.Paths)
+	}
+	if got := strings.Join(cfg.enabledProviders(), ","); got != "github,google" {
+		t.Errorf("enabledProviders wrongly returned %s", got)
+	}
+	if got := cfg.callbackURL("github"); got != "https://chat.example.com/auth/callback/github" {
+		t.Errorf("callbackURL wrongly returned %s", got)
+	}
+	if chain := cfg.avatarChain().(TryAvatars); len(chain) != 2 {
+		t.Errorf("avatarChain should have 2 strategies, got %d", len(chain))
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	_, err := loadConfig([]string{"-publicurl", "localhost", "-avatars", "magic", "-brokerlisten", "0.0.0.0:7000"}, noEnv)
+	if err == nil {
+		t.Fatal("loadConfig should reject an incomplete config")
+	}
+	for _, problem := range []string{"public_url", "security_key", "provider", "magic", "broker_secret"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("validation error should mention %s: %s", problem, err)
+		}
+	}
+}
+
+func TestBrokerListenAddr(t *testing.T) {
+	tests := []struct {
+		listen, secret string
+		want           string
+		valid          bool
+	}{
+		{":7000", "", "127.0.0.1:7000", true},
+		{"localhost:7000", "", "localhost:7000", true},
+		{"[::1]:7000", "", "[::1]:7000", true},
+		{"10.0.0.1:7000", "", "10.0.0.1:7000", false},
+		{":7000", "s3cret", ":7000", true},
+		{"10.0.0.1:7000", "s3cret", "10.0.0.1:7000", true},
+	}
+	for _, test := range tests {
+		cfg := defaultConfig()
+		cfg.BrokerListen, cfg.BrokerSecret = test.listen, test.secret
+		if got := cfg.brokerListenAddr(); got != test.want {
+			t.Errorf("brokerListenAddr(%q, %q) = %q, want %q", test.listen, test.secret, got, test.want)
+		}
+		err := cfg.validate()
+		if got := err == nil || !strings.Contains(err.Error(), "broker"); got != test.valid {
+			t.Errorf("validate(%q, %q) wrongly returned %v", test.listen, test.secret, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrUnknownUser is returned when a direct message is addressed to a
+// user the server has never seen.
+var ErrUnknownUser = errors.New("chat: unknown user")
+
+// userIDPattern matches the UniqueIDs of users: hex digests for OAuth,
+// OpenID Connect and local accounts.
+var userIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// validUserID reports whether id can be the UniqueID of a user, e.g.
+// before it goes into the history key of a conversation.
+func validUserID(id string) bool {
+	return userIDPattern.MatchString(id)
+}
+
+// userInfo is what the server knows about a user.
+type userInfo struct {
+	UserID    string `json:"userid"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// usersTopic is the broker room on which servers announce the users
+// who log in, so every server can find them. Room names cannot start
+// with "~", so it never clashes with a room.
+const usersTopic = "~users"
+
+// userSaveDelay is how long the index waits after a change before it
+// saves its file.
+const userSaveDelay = time.Second
+
+// userIndex maps users to their open sockets in every room and
+// remembers every user that logged in or connected, here or on another
+// server sharing the broker. Rooms update it from their join and leave
+// cases. With a file the known users survive a restart.
+type userIndex struct {
+	mu      sync.Mutex
+	clients map[string]map[*client]bool
+	known   map[string]userInfo
+	// sent holds the IDs of recent direct messages to drop ones sent again.
+	sent  *seenIDs
+	saver *saver
+	// broker and node are set by share.
+	broker Broker
+	node   string
+}
+
+// users is the user index shared by all rooms.
+var users = newUserIndex()
+
+func newUserIndex() *userIndex {
+	return &userIndex{
+		clients: make(map[string]map[*client]bool),
+		known:   make(map[string]userInfo),
+		sent:    newSeenIDs(4096),
+	}
+}
+
+// openUserIndex loads the users saved in filename, if any, and saves
+// the users it learns about back to it until Close is called.
+func openUserIndex(filename string) (*userIndex, error) {
+	idx := newUserIndex()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &idx.known); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	idx.saver = newFileSaver(filename, userSaveDelay, func() ([]byte, error) {
+		idx.mu.Lock()
+		defer idx.mu.Unlock()
+		return json.Marshal(idx.known)
+	})
+	return idx, nil
+}
+
+// Close stops saving the known users in the background and saves them
+// one last time.
+func (idx *userIndex) Close() error {
+	return idx.saver.Close()
+}
+
+// share announces the users who log in here to the other servers on
+// broker and learns the users they announce, until the returned
+// function is called.
+func (idx *userIndex) share(broker Broker, node string) func() {
+	idx.mu.Lock()
+	idx.broker, idx.node = broker, node
+	idx.mu.Unlock()
+	sub, cancel := broker.Subscribe(usersTopic)
+	go func() {
+		for msg := range sub {
+			if msg.Origin == node {
+				continue
+			}
+			idx.learn(userInfo{UserID: msg.UserID, Name: msg.Name, AvatarURL: msg.AvatarURL})
+		}
+	}()
+	return cancel
+}
+
+// remember records the user described by userData.
+func (idx *userIndex) remember(userData map[string]interface{}) {
+	idx.learn(userInfoFrom(userData))
+}
+
+// login remembers the user who just logged in and tells the other
+// servers about them.
+func (idx *userIndex) login(userData map[string]interface{}) {
+	info := userInfoFrom(userData)
+	idx.learn(info)
+	idx.mu.Lock()
+	broker, node := idx.broker, idx.node
+	idx.mu.Unlock()
+	if broker == nil || info.UserID == "" {
+		return
+	}
+	msg := &message{V: protocolVersion, Type: typeJoin, ID: newMessageID(), Origin: node, When: time.Now(),
+		UserID: info.UserID, Name: info.Name, AvatarURL: info.AvatarURL}
+	// 실패해도 다른 서버는 세션 저장소나 다음 로그인 때 이 사용자를 알게 된다.
+	broker.Publish(usersTopic, msg)
+}
+
+func userInfoFrom(userData map[string]interface{}) userInfo {
+	var info userInfo
+	info.UserID, _ = userData["userid"].(string)
+	info.Name, _ = userData["name"].(string)
+	info.AvatarURL, _ = userData["avatar_url"].(string)
+	return info
+}
+
+// learn records info and reports whether it was new or changed.
+func (idx *userIndex) learn(info userInfo) bool {
+	if info.UserID == "" {
+		return false
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if old, ok := idx.known[info.UserID]; ok && old == info {
+		return false
+	}
+	idx.known[info.UserID] = info
+	idx.saver.touch()
+	return true
+}
+
+// lookup returns the known user with the given ID. Users this server
+// has not seen since it started are looked up in the session store, so
+// direct messages still reach them after a restart.
+func (idx *userIndex) lookup(userID string) (userInfo, bool) {
+	idx.mu.Lock()
+	info, ok := idx.known[userID]
+	idx.mu.Unlock()
+	if ok || sessions == nil {
+		return info, ok
+	}
+	list, err := sessions.store.ByUser(userID)
+	if err != nil || len(list) == 0 {
+		return userInfo{}, false
+	}
+	// 가장 최근 세션의 이름과 아바타를 쓴다.
+	info = userInfoFrom(list[len(list)-1].Data)
+	if info.UserID != userID {
+		return userInfo{}, false
+	}
+	idx.learn(info)
+	return info, true
+}
+
+// all returns every known user sorted by name.
+func (idx *userIndex) all() []userInfo {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	infos := make([]userInfo, 0, len(idx.known))
+	for _, info := range idx.known {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (idx *userIndex) add(c *client) {
+	idx.remember(c.userData)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	id := c.userID()
+	if idx.clients[id] == nil {
+		idx.clients[id] = make(map[*client]bool)
+	}
+	idx.clients[id][c] = true
+}
+
+func (idx *userIndex) remove(c *client) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	id := c.userID()
+	delete(idx.clients[id], c)
+	if len(idx.clients[id]) == 0 {
+		delete(idx.clients, id)
+	}
+}
+
+// sockets returns the open clients of the user, in any room.
+func (idx *userIndex) sockets(userID string) []*client {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	clients := make([]*client, 0, len(idx.clients[userID]))
+	for c := range idx.clients[userID] {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// firstSend reports whether the direct message with the given ID was
+// not sent before.
+func (idx *userIndex) firstSend(id string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.sent.add(id)
+}
+
+// directKey is the history key of the conversation between two users.
+// Room names cannot start with "@", so it never clashes with a room.
+func directKey(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return "@" + a + "+" + b
+}
+
+// sendDirect stores a direct message and delivers it to every socket
+// of the recipient and of the sender, whatever room they are in.
+func (c *client) sendDirect(msg *message) {
+	if _, ok := users.lookup(msg.To); !ok {
+		c.room.send(errorMessage(c, ErrUnknownUser))
+		return
+	}
+	// 같은 Key 로 다시 보낸 귓속말
+	if msg.Key != "" && !users.firstSend(msg.ID) {
+		return
+	}
+	if err := c.room.store.Append(directKey(msg.UserID, msg.To), msg); err != nil {
+		c.room.tracer.Trace("Failed to store direct message: ", err)
+	}
+	recipients := users.sockets(msg.To)
+	if msg.To != msg.UserID {
+		recipients = append(recipients, users.sockets(msg.UserID)...)
+	}
+	for _, to := range recipients {
+		copied := *msg
+		copied.to = to
+		// 받는 사람이 있는 룸의 run 루프가 전달한다.
+		to.room.send(&copied)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNoMessage is returned when an edit, delete or reaction is about
+	// a message that is not in the history of the room.
+	ErrNoMessage = errors.New("chat: no such message")
+	// ErrNotAuthor is returned when a user changes someone else's message.
+	ErrNotAuthor = errors.New("chat: not your message")
+	// ErrEditWindow is returned when a message is too old to be changed.
+	ErrEditWindow = errors.New("chat: message is too old to change")
+	// ErrTooManyReactions is returned when a message has all the
+	// different reactions it can have.
+	ErrTooManyReactions = errors.New("chat: too many reactions")
+
+	// errNoChange means the change would not change anything, e.g.
+	// a reaction the user already added. It is dropped without telling.
+	errNoChange = errors.New("chat: nothing to change")
+)
+
+const (
+	// defaultEditWindow is how long authors can edit or delete their messages.
+	defaultEditWindow = 15 * time.Minute
+	// maxReactions is the most different emoji a message can get.
+	maxReactions = 20
+)
+
+// checkChange checks that the sender of an edit, delete or reaction may
+// make it to the message it targets in the history of the room.
+// Authors can edit and delete their messages for editWindow, or forever
+// if it is not positive. Moderators can delete any message. Anyone who
+// may write to the room can react.
+func (r *room) checkChange(msg *message) error {
+	target, err := r.store.Lookup(r.name, msg.Target)
+	if err != nil {
+		return err
+	}
+	author := target.UserID == msg.UserID
+	inWindow := r.editWindow <= 0 || msg.When.Sub(target.When) <= r.editWindow
+	switch msg.Type {
+	case typeEdit:
+		if !author {
+			return ErrNotAuthor
+		}
+		if !inWindow {
+			return ErrEditWindow
+		}
+		if msg.Message == target.Message {
+			return errNoChange
+		}
+	case typeDelete:
+		// 답글이 지워지면 스레드 요약이 바뀐다. (thread.go)
+		msg.Parent = target.Parent
+		if moderation.role(r.name, msg.UserID) >= roleModerator {
+			return nil
+		}
+		if !author {
+			return ErrNotAuthor
+		}
+		if !inWindow {
+			return ErrEditWindow
+		}
+	case typeReaction:
+		reacted := containsString(target.Reactions[msg.Emoji], msg.UserID)
+		if reacted != msg.Remove {
+			return errNoChange
+		}
+		if _, ok := target.Reactions[msg.Emoji]; !ok && len(target.Reactions) >= maxReactions {
+			return ErrTooManyReactions
+		}
+	}
+	return nil
+}
+
+// applyChange returns a copy of msg with the edit or reaction change
+// applied. msg itself is not modified since it may be shared.
+func applyChange(msg, change *message) *message {
+	copied := *msg
+	switch change.Type {
+	case typeEdit:
+		when := change.When
+		copied.Message = change.Message
+		copied.Rich = change.Rich
+		copied.Edited = &when
+	case typeReaction:
+		reactions := make(map[string][]string, len(msg.Reactions)+1)
+		for emoji, users := range msg.Reactions {
+			reactions[emoji] = users
+		}
+		var users []string
+		for _, id := range reactions[change.Emoji] {
+			if id != change.UserID {
+				users = append(users, id)
+			}
+		}
+		if !change.Remove {
+			users = append(users, change.UserID)
+		}
+		if len(users) == 0 {
+			delete(reactions, change.Emoji)
+		} else {
+			reactions[change.Emoji] = users
+		}
+		copied.Reactions = reactions
+		if len(reactions) == 0 {
+			copied.Reactions = nil
+		}
+	}
+	return &copied
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStoreChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileStore, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+
+	for name, store := range map[string]MessageStore{"ring": NewRingBufferStore(10), "file": fileStore} {
+		original := &message{Type: typeChat, ID: "m1", UserID: "alice", Message: "helo"}
+		store.Append("room", original)
+		store.Append("room", &message{Type: typeEdit, Target: "m1", UserID: "alice", Message: "hello", When: time.Now()})
+		store.Append("room", &message{Type: typeReaction, Target: "m1", UserID: "bob", Emoji: "👍"})
+		store.Append("room", &message{Type: typeReaction, Target: "m1", UserID: "carol", Emoji: "👍"})
+		store.Append("room", &message{Type: typeReaction, Target: "m1", UserID: "bob", Emoji: "👍", Remove: true})
+
+		msgs, _ := lastMessages(store, "room", 10)
+		if len(msgs) != 1 {
+			t.Fatalf("%s: changes should not show up as messages, got %v", name, msgs)
+		}
+		if msgs[0].Message != "hello" || msgs[0].Edited == nil {
+			t.Errorf("%s: history should have the edited message, got %+v", name, msgs[0])
+		}
+		if got := msgs[0].Reactions["👍"]; len(got) != 1 || got[0] != "carol" {
+			t.Errorf("%s: history should have carol's reaction only, got %v", name, msgs[0].Reactions)
+		}
+		if original.Message != "helo" || original.Reactions != nil {
+			t.Errorf("%s: stored records should not be modified, got %+v", name, original)
+		}
+		if msg, err := store.Lookup("room", "m1"); err != nil || msg.Message != "hello" {
+			t.Errorf("%s: Lookup wrongly returned %v, %v", name, msg, err)
+		}
+		if _, err := store.Lookup("room", "nope"); err != ErrNoMessage {
+			t.Errorf("%s: Lookup should return ErrNoMessage, got %v", name, err)
+		}
+	}
+}
+
+func TestRoomChanges(t *testing.T) {
+	defer func(old *moderationStore) { moderation = old }(moderation)
+	moderation = newModerationStore()
+	moderation.owners["mod"] = true
+
+	r := newRoom()
+	r.name = "test"
+	r.editWindow = time.Minute
+	go r.run()
+	defer close(r.quit)
+	alice := newTestUserClient(t, r, "alice")
+	bob := newTestUserClient(t, r, "bob")
+	mod := newTestUserClient(t, r, "mod")
+	r.join <- alice
+	r.join <- bob
+	r.join <- mod
+	receive(t, alice, 2) // bob and mod joined
+	receive(t, bob, 1)   // mod joined
+
+	send := func(c *client, msg *message) {
+		msg.UserID, msg.from = c.userID(), c
+		if msg.When.IsZero() {
+			msg.When = time.Now()
+		}
+		r.forward <- msg
+		waitForRoom(r)
+	}
+	expectError := func(c *client, want error) {
+		t.Helper()
+		if msgs := receive(t, c, 1); len(msgs) != 1 || msgs[0].Type != typeError || msgs[0].Message != want.Error() {
+			t.Errorf("%s should get %v, got %+v", c.userID(), want, msgs)
+		}
+	}
+	send(alice, &message{Type: typeChat, ID: "new", Message: "helo"})
+	send(alice, &message{Type: typeChat, ID: "old", Message: "old news", When: time.Now().Add(-2 * time.Minute)})
+	receive(t, bob, 2)
+	receive(t, alice, 2)
+
+	send(alice, &message{Type: typeEdit, Target: "new", Message: "hello"})
+	if msgs := receive(t, bob, 1); msgs[0].Type != typeEdit || msgs[0].Message != "hello" {
+		t.Errorf("room should be told about the edit, got %+v", msgs[0])
+	}
+	receive(t, alice, 1)
+	send(bob, &message{Type: typeEdit, Target: "new", Message: "pwned"})
+	expectError(bob, ErrNotAuthor)
+	send(alice, &message{Type: typeEdit, Target: "old", Message: "new news"})
+	expectError(alice, ErrEditWindow)
+	send(bob, &message{Type: typeDelete, Target: "new"})
+	expectError(bob, ErrNotAuthor)
+	send(bob, &message{Type: typeEdit, Target: "gone", Message: "hi"})
+	expectError(bob, ErrNoMessage)
+
+	send(bob, &message{Type: typeReaction, Target: "new", Emoji: "👍"})
+	send(bob, &message{Type: typeReaction, Target: "new", Emoji: "👍"})
+	if msgs := receive(t, alice, 1); msgs[0].Type != typeReaction {
+		t.Errorf("room should be told about the reaction, got %+v", msgs[0])
+	}
+	receive(t, bob, 1)
+	if len(alice.send) != 0 {
+		t.Error("the same reaction twice should only count once")
+	}
+
+	send(mod, &message{Type: typeDelete, Target: "old"})
+	if msgs := receive(t, alice, 1); msgs[0].Type != typeDelete {
+		t.Errorf("moderator should delete old messages of others, got %+v", msgs[0])
+	}
+	msgs, _ := lastMessages(r.store, "test", 10)
+	if len(msgs) != 1 || msgs[0].Message != "hello" || len(msgs[0].Reactions["👍"]) != 1 {
+		t.Errorf("history should have the changes applied, got %+v", msgs)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>{{.Title}}</title>
+    <link rel="stylesheet" href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.6/css/bootstrap.min.css">
+</head>
+<body>
+<div class="container">
+    <div class="page-header">
+        <h1>{{.Status}} {{.StatusText}}</h1>
+    </div>
+    <div class="alert alert-danger">{{.Title}}</div>
+    <p><a href="/login">Sign in again</a> or <a href="/chat">back to chat</a></p>
+</div>
+</body>
+</html>`))
+
+// errorPage shows the user a page saying what went wrong. err has the
+// details, which are logged but not shown since they may be internal.
+func errorPage(w http.ResponseWriter, r *http.Request, status int, title string, err error) {
+	if err != nil {
+		log.Println(r.Method, r.URL.Path, "-", title, "-", err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	errorTemplate.Execute(w, map[string]interface{}{
+		"Status":     status,
+		"StatusText": http.StatusText(status),
+		"Title":      title,
+	})
+}
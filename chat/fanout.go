@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// slowPolicy decides what a room does when a client's send buffer is full.
+type slowPolicy int
+
+const (
+	// dropOldest throws away the oldest queued message to make room.
+	dropOldest slowPolicy = iota
+	// dropNewest throws away the message that did not fit.
+	dropNewest
+	// disconnectSlow drops the client.
+	disconnectSlow
+)
+
+var slowPolicyNames = map[slowPolicy]string{
+	dropOldest:     "drop-oldest",
+	dropNewest:     "drop-newest",
+	disconnectSlow: "disconnect",
+}
+
+func (p slowPolicy) String() string {
+	return slowPolicyNames[p]
+}
+
+func parseSlowPolicy(s string) (slowPolicy, error) {
+	for p, name := range slowPolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("chat: unknown slow consumer policy %q", s)
+}
+
+// parseSlowPolicies parses a default policy followed by per-room overrides.
+// format: {policy}[,{room}={policy}...] e.g. "drop-oldest,lobby=disconnect"
+func parseSlowPolicies(s string) (slowPolicy, map[string]slowPolicy, error) {
+	parts := strings.Split(s, ",")
+	def, err := parseSlowPolicy(parts[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	rooms := make(map[string]slowPolicy)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || !validRoomName(kv[0]) {
+			return 0, nil, fmt.Errorf("chat: invalid room policy %q", part)
+		}
+		if rooms[kv[0]], err = parseSlowPolicy(kv[1]); err != nil {
+			return 0, nil, err
+		}
+	}
+	return def, rooms, nil
+}
+
+// fanoutStats counts what happened to forwarded messages.
+// 다른 고루틴(/rooms)에서 읽으므로 atomic 으로 다룬다.
+type fanoutStats struct {
+	Delivered    int64 `json:"delivered"`
+	Dropped      int64 `json:"dropped"`
+	Disconnected int64 `json:"disconnected"`
+}
+
+func (s *fanoutStats) snapshot() fanoutStats {
+	return fanoutStats{
+		Delivered:    atomic.LoadInt64(&s.Delivered),
+		Dropped:      atomic.LoadInt64(&s.Dropped),
+		Disconnected: atomic.LoadInt64(&s.Disconnected),
+	}
+}
+
+// deliver queues msg on the client's send channel without ever blocking
+// the room, applying the room's slowPolicy if the buffer is full.
+func (r *room) deliver(c *client, msg *message) {
+	if !r.clients[c] {
+		// 이미 끊기로 한 클라이언트. leave 로 정리될 때까지 건너뛴다.
+		return
+	}
+	select {
+	case c.send <- msg:
+		atomic.AddInt64(&r.stats.Delivered, 1)
+		return
+	default:
+	}
+	switch r.policy {
+	case dropOldest:
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- msg:
+			atomic.AddInt64(&r.stats.Delivered, 1)
+		default:
+		}
+		atomic.AddInt64(&r.stats.Dropped, 1)
+		r.tracer.Trace(" -- client is slow, dropped oldest message")
+	case dropNewest:
+		atomic.AddInt64(&r.stats.Dropped, 1)
+		r.tracer.Trace(" -- client is slow, dropped message")
+	case disconnectSlow:
+		// 소켓을 닫으면 client.read() 가 끝나고 leave 채널로 정리된다.
+		r.clients[c] = false
+		go c.closeWith(websocket.CloseTryAgainLater, "client too slow")
+		atomic.AddInt64(&r.stats.Disconnected, 1)
+		r.tracer.Trace(" -- client is slow, disconnected")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// historySize is the number of messages kept per room in memory.
+	historySize = 1000
+	// replaySize is the number of messages sent to a client when it joins.
+	replaySize = 50
+	// resumeSize is the most records sent to a client that reconnects.
+	resumeSize = 500
+	// maxHistoryPage is the largest page served by /history.
+	maxHistoryPage = 200
+)
+
+// historyHandler serves older messages of a room, or of the direct
+// conversation with another user, so the UI can scroll back.
+// format: /history?room={name}&before={RFC3339 time}&limit={n}
+// or /history?with={userid}&before={RFC3339 time}&limit={n}
+type historyHandler struct {
+	store MessageStore
+}
+
+func (h *historyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	room := q.Get("room")
+	if with := q.Get("with"); with != "" {
+		// 다른 사람의 대화는 볼 수 없도록 현재 사용자 기준으로만 키를 만든다.
+		user, err := currentUser(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// with 은 저장소 키가 되므로 알려진 사용자의 ID 만 받는다.
+		if !validUserID(with) {
+			http.Error(w, "invalid with", http.StatusBadRequest)
+			return
+		}
+		if _, ok := users.lookup(with); !ok {
+			http.Error(w, ErrUnknownUser.Error(), http.StatusNotFound)
+			return
+		}
+		room = directKey(user.Get("userid").Str(), with)
+	} else {
+		if !validRoomName(room) {
+			http.Error(w, "invalid room", http.StatusBadRequest)
+			return
+		}
+		// 차단된 사용자는 룸의 지난 메세지도 볼 수 없다.
+		if refuseBanned(w, req, room) {
+			return
+		}
+	}
+	var before time.Time
+	if s := q.Get("before"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			http.Error(w, "invalid before: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		before = t
+	}
+	limit := replaySize
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxHistoryPage {
+		limit = maxHistoryPage
+	}
+	msgs, err := h.store.Before(room, before, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msgs == nil {
+		msgs = []*message{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msgs)
+}
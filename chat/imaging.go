@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// squareThumbnail crops the centre square of src and scales it to size x size.
+// 축소는 박스 필터(영역 평균), 확대는 최근접 픽셀로 처리한다.
+func squareThumbnail(src image.Image, size int) *image.NRGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	if side == 0 {
+		return dst
+	}
+	for y := 0; y < size; y++ {
+		y0 := crop.Min.Y + y*side/size
+		y1 := crop.Min.Y + (y+1)*side/size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size; x++ {
+			x0 := crop.Min.X + x*side/size
+			x1 := crop.Min.X + (x+1)*side/size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// 미리 곱해진(premultiplied) 값으로 평균을 낸다.
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			c := color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)}
+			dst.Set(x, y, c)
+		}
+	}
+	return dst
+}
+
+// identiconGrid is the number of cells on each side of an identicon.
+const identiconGrid = 5
+
+// identiconBackground is the colour behind the cells of every identicon.
+var identiconBackground = color.NRGBA{240, 240, 240, 255}
+
+// identiconPattern derives the colour and the cells of id's identicon.
+// 왼쪽 세 열만 해시로 정하고 오른쪽은 좌우 대칭
+func identiconPattern(id string) (color.NRGBA, [identiconGrid][identiconGrid]bool) {
+	sum := md5.Sum([]byte(id))
+	fg := color.NRGBA{sum[0]/2 + 64, sum[1]/2 + 64, sum[2]/2 + 64, 255}
+	var cells [identiconGrid][identiconGrid]bool
+	for row := 0; row < identiconGrid; row++ {
+		for col := 0; col < (identiconGrid+1)/2; col++ {
+			bit := row*3 + col
+			on := sum[3+bit/8]>>(uint(bit)%8)&1 == 1
+			cells[row][col], cells[row][identiconGrid-1-col] = on, on
+		}
+	}
+	return fg, cells
+}
+
+// identiconCell returns the square of the cell at row, col in an
+// identicon of size pixels. 셀 크기를 정수로 맞춰 모든 셀이 같은 크기가 된다.
+func identiconCell(row, col, size int) image.Rectangle {
+	cell := (size - 2*(size/12)) / identiconGrid
+	margin := (size - cell*identiconGrid) / 2
+	return image.Rect(0, 0, cell, cell).Add(image.Pt(margin+col*cell, margin+row*cell))
+}
+
+// identicon draws a symmetric 5x5 pattern derived from id, so a user without
+// an uploaded picture still gets a stable, recognizable avatar.
+func identicon(id string, size int) *image.NRGBA {
+	fg, cells := identiconPattern(id)
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{identiconBackground}, image.Point{}, draw.Src)
+	for row := range cells {
+		for col, on := range cells[row] {
+			if on {
+				draw.Draw(dst, identiconCell(row, col, size), &image.Uniform{fg}, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return dst
+}
+
+// identiconSVG draws the same identicon as identicon as an SVG document.
+func identiconSVG(id string, size int) []byte {
+	fg, cells := identiconPattern(id)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, size, size, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="%s"/>`, size, size, hexColor(identiconBackground))
+	fmt.Fprintf(&buf, `<g fill="%s">`, hexColor(fg))
+	for row := range cells {
+		for col, on := range cells[row] {
+			if on {
+				r := identiconCell(row, col, size)
+				fmt.Fprintf(&buf, `<rect x="%d" y="%d" width="%d" height="%d"/>`, r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+			}
+		}
+	}
+	buf.WriteString("</g></svg>\n")
+	return buf.Bytes()
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// go test -run Identicon -update rewrites the golden images in testdata.
+var update = flag.Bool("update", false, "update golden files")
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	golden := filepath.Join("testdata", name)
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%s: %s (run go test -update to create it)", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file", name)
+	}
+}
+
+func TestIdenticonGolden(t *testing.T) {
+	for _, id := range []string{"aa96011bdd1da73b97c0539d229bb274", "abc"} {
+		for _, size := range []int{32, 128} {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, identicon(id, size)); err != nil {
+				t.Fatal(err)
+			}
+			name := fmt.Sprintf("identicon-%s-%d", id, size)
+			checkGolden(t, name+".png", buf.Bytes())
+			checkGolden(t, name+".svg", identiconSVG(id, size))
+		}
+	}
+}
+
+func TestIdenticonSymmetric(t *testing.T) {
+	for _, id := range []string{"abc", "def", "ghi"} {
+		_, cells := identiconPattern(id)
+		for row := range cells {
+			for col := range cells[row] {
+				if cells[row][col] != cells[row][identiconGrid-1-col] {
+					t.Errorf("%s: identicon should be symmetric, row %d differs", id, row)
+				}
+			}
+		}
+	}
+	// 셀이 가운데에 오도록 배치된다.
+	img := identicon("abc", 64)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 32; x++ {
+			if img.At(x, y) != img.At(63-x, y) {
+				t.Fatalf("identicon should be symmetric, differs at %d,%d", x, y)
+			}
+		}
+	}
+}
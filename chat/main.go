@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"html/template"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
-	"text/template"
+	"syscall"
 
+	"github.com/jihuichoi/GPB/trace"
 	"github.com/stretchr/gomniauth"
-	"github.com/stretchr/gomniauth/providers/facebook"
-	"github.com/stretchr/gomniauth/providers/github"
-	"github.com/stretchr/gomniauth/providers/google"
-	"github.com/stretchr/objx"
 )
 
 // set the active Avatar imlemetation
@@ -23,6 +26,12 @@ var avatars Avatar = TryAvatars{
 	UseGravatar,
 }
 
+// templatesDir is where the templates are read from.
+var templatesDir = "templates"
+
+// loginProviders are the names of the enabled OAuth providers.
+var loginProviders []string
+
 // teml represents a single template
 type templateHandler struct {
 	once     sync.Once
@@ -36,15 +45,32 @@ type templateHandler struct {
 // }
 func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t.once.Do(func() {
-		t.templ = template.Must(template.ParseFiles(filepath.Join("templates", t.filename)))
+		t.templ = template.Must(template.ParseFiles(filepath.Join(templatesDir, t.filename)))
 	})
 
 	// ch2: Oauth2 를 통해 provider 로 부터 받아 쿠키에 저장한 사용자 정보를 불러온다.
 	data := map[string]interface{}{
 		"Host": r.Host,
+		"Room": defaultRoomName,
+		// 로그인 페이지에 설정에서 켠 provider 만 보여준다.
+		"Providers": loginProviders,
+	}
+	if accounts != nil {
+		data["Local"] = true
+		data["Registration"] = accounts.allowRegistration
+	}
+	if msg, ok := loginErrors[r.URL.Query().Get("error")]; ok {
+		data["Error"] = msg
+	}
+	// 로그인한 뒤 돌아갈 주소 (state.go 의 safeNext 로 이 사이트 안으로 제한)
+	if next := r.URL.Query().Get("next"); next != "" {
+		data["Next"] = safeNext(next)
 	}
-	if authCookie, err := r.Cookie("auth"); err == nil {
-		data["UserData"] = objx.MustFromBase64(authCookie.Value)
+	if room := r.URL.Query().Get("room"); validRoomName(room) {
+		data["Room"] = room
+	}
+	if userData, err := currentUser(r); err == nil {
+		data["UserData"] = userData
 	}
 
 	// 템플릿에 request 정보를 전달
@@ -59,30 +85,147 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
-	// 채팅 사이트 주소가 하드코딩됨 (localhost:8080)
-	// 이를 커맨드라인에서 -addr 라는 플래그로 처리하도록 경 ./chat -addr=":3000" 이라는 형식으로 실행이 가능해짐
-	var addr = flag.String("host", ":8080", "The addr of the application")
-	flag.Parse() // parse the flags
+	// 설정은 기본값 < 설정 파일(-config) < 환경변수(CHAT_*) < 플래그 순으로 덮어쓴다. (config.go)
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	templatesDir = cfg.Paths.Templates
+	avatarsDir = cfg.Paths.Avatars
+	avatars = cfg.avatarChain()
+	if cfg.Avatars.Debug {
+		avatarTracer = trace.New(os.Stdout)
+	}
+	loginProviders = cfg.enabledProviders()
+	secureCookies = cfg.SecureCookies
+
+	// auth 쿠키 서명 키. 지정하지 않으면 재시작할 때마다 모두 다시 로그인해야 한다.
+	secret := []byte(cfg.CookieKey)
+	if len(secret) == 0 {
+		log.Println("No cookie key given, using a random cookie key")
+		secret = randomSecret(32)
+	}
+	if tokens, err = newTokenCodec(secret, cfg.EncryptCookie, cfg.CookieMaxAge.Duration); err != nil {
+		log.Fatalln("Failed to set up auth tokens:", err)
+	}
+
+	var sessionStore SessionStore = NewMemorySessionStore()
+	if cfg.SessionFile != "" {
+		if sessionStore, err = NewFileSessionStore(cfg.SessionFile); err != nil {
+			log.Fatalln("Failed to open sessions:", err)
+		}
+	}
+	sessions = newSessionManager(sessionStore, cfg.IdleTimeout.Duration, cfg.CookieMaxAge.Duration)
+
+	// 언급 알림함은 사용자가 없는 동안에도 남는다. (notification.go)
+	if cfg.NotificationFile != "" {
+		if notifications, err = openNotificationStore(cfg.NotificationFile); err != nil {
+			log.Fatalln("Failed to open notifications:", err)
+		}
+	}
+	// DM 받는 사람을 재시작 뒤에도 찾을 수 있도록 사용자 목록을 저장한다. (direct.go)
+	if cfg.UserFile != "" {
+		if users, err = openUserIndex(cfg.UserFile); err != nil {
+			log.Fatalln("Failed to open users:", err)
+		}
+	}
+
+	// OAuth 없이도 쓸 수 있도록 로컬 계정 (accounts.go)
+	if cfg.Local.Enabled {
+		userStore, err := cfg.userStore()
+		if err != nil {
+			log.Fatalln("Failed to open local accounts:", err)
+		}
+		if closer, ok := userStore.(io.Closer); ok {
+			defer closer.Close()
+		}
+		if accounts, err = newLocalAccounts(userStore, cfg.Local.BcryptCost); err != nil {
+			log.Fatalln("Failed to set up local accounts:", err)
+		}
+		accounts.allowRegistration = cfg.Local.AllowRegistration
+	}
+
+	// 룸 역할, 차단 목록과 감사 기록 (moderation.go)
+	if moderation, err = cfg.moderationStore(); err != nil {
+		log.Fatalln("Failed to open moderation state:", err)
+	}
+	moderation.audit = log.Writer()
+	if cfg.Moderation.AuditLog != "" {
+		f, err := os.OpenFile(cfg.Moderation.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalln("Failed to open audit log:", err)
+		}
+		defer f.Close()
+		moderation.audit = f
+	}
 
 	// Oauth2
 	// setup gomniauth
-	gomniauth.SetSecurityKey("PUT YOUR AUTH KEY HERE")
-	gomniauth.WithProviders(
-		facebook.New("233530930663961", "c4dc9bf4d7dcc93c8d70f53610470a4d",
-			"http://localhost:8080/auth/callback/facebook"),
-		github.New("4530f6f362f4798105a3", "60433e0e932ccb55cc36df5f0b8962476d4f6473",
-			"http://localhost:8080/auth/callback/github"),
-		google.New("767497021571-q4l7entsul2qhjd4fmvt5it0cppe9n0m.apps.googleusercontent.com", "Ow8ry0I_rz6UHtHQIr3ZT6ol",
-			"http://localhost:8080/auth/callback/google"),
-	)
+	// gomniauth.SetSecurityKey("PUT YOUR AUTH KEY HERE")
+	// gomniauth.WithProviders(facebook.New(...), github.New(...), google.New(...))
+	// 키와 provider 는 설정 파일에서 읽는다. callback 주소는 public_url 로 만든다.
+	gomniauth.SetSecurityKey(cfg.SecurityKey)
+	gomniauth.WithProviders(cfg.providers()...)
+	// issuer 가 있는 provider 는 일반 OpenID Connect 로 처리한다. (oidc.go)
+	oidcProviders = cfg.oidcProviders()
 
 	// newRoom 함수로 새 룸을 만든다.
 	// r := newRoom(UseFileSystemAvatar)
 	// r := newRoom(UseGravatar)
 	// r := newRoom(UseAuthAvatar)
-	r := newRoom()
+	// r := newRoom()
+	// 룸은 이름별로 registry 가 필요할 때 만들고, 마지막 클라이언트가 떠나면 닫는다.
+	rooms := newRoomRegistry()
+	// 세션이 취소되면 그 세션으로 열린 웹소켓을 모든 룸에서 끊는다.
+	sessions.onRevoke = func(ids []string) {
+		revoked := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			revoked[id] = true
+		}
+		rooms.disconnect(func(c *client) bool { return revoked[c.sessionID] })
+	}
+	rooms.opts = socketOptions{
+		pingInterval:   cfg.PingInterval.Duration,
+		pongWait:       cfg.PongWait.Duration,
+		writeWait:      cfg.WriteWait.Duration,
+		maxMessageSize: cfg.MaxMessageSize,
+	}
+	rooms.editWindow = cfg.EditWindow.Duration
+	rooms.policy, rooms.policies, _ = parseSlowPolicies(cfg.SlowPolicy) // validate 에서 이미 확인함
+	// 여러 서버를 띄울 때 broker 를 통해 같은 룸의 메세지를 주고받는다.
+	if cfg.Node != "" {
+		rooms.node = cfg.Node
+	}
+	if cfg.BrokerListen != "" {
+		l, err := net.Listen("tcp", cfg.brokerListenAddr())
+		if err != nil {
+			log.Fatalln("Failed to start broker:", err)
+		}
+		log.Println("Starting broker on", l.Addr())
+		go NewBrokerServer([]byte(cfg.BrokerSecret)).Serve(l)
+	}
+	if cfg.Broker != "" {
+		broker, err := DialBroker(cfg.Broker, []byte(cfg.BrokerSecret), rooms.tracer)
+		if err != nil {
+			log.Fatalln("Failed to connect to broker:", err)
+		}
+		defer broker.Close()
+		rooms.broker = broker
+		// 다른 서버에 로그인한 사용자에게도 DM 을 보낼 수 있도록 로그인을 알린다.
+		defer users.share(broker, rooms.node)()
+	}
+	if cfg.HistoryDir != "" {
+		store, err := NewFileStore(cfg.HistoryDir)
+		if err != nil {
+			log.Fatalln("Failed to open history:", err)
+		}
+		rooms.store = store
+	}
 	// tracer 출력을 stdout 으로 내보냄
-	// r.tracer = trace.New(os.Stdout)
+	// rooms.tracer = trace.New(os.Stdout)
 
 	// net/http 기본 핸들러함수 사용
 	// 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -108,37 +251,87 @@ func main() {
 	// http.Handle("/", &templateHandler{filename: "chat.html"})
 
 	// bootstrap 등 static html 부분을 위한 항목
-	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets/"))))
+	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir(cfg.Paths.Assets))))
 
 	// ch2: 주소를 chat 으로 바꾸고, 인증을 위해 MustAuth로 감싼다. 이러면 templateHanlder 는 인증이 되어야만 동작한다.
 	http.Handle("/chat", MustAuth(&templateHandler{filename: "chat.html"})) // MustAuth 를 통과하지 못하면, /login 으로 이동한다.
 	http.Handle("/login", &templateHandler{filename: "login.html"})
 	http.HandleFunc("/auth/", loginHandler)
-	http.Handle("/room", r)                                           // 새 룸을 개설
-	http.Handle("/upload", &templateHandler{filename: "upload.html"}) // 아바타 사진 업로드
+	http.HandleFunc("/auth/local/", localAuthHandler) // 아이디/비밀번호 로그인, 가입
+	http.Handle("/room", rooms)                       // 기본 룸 (general)
+	http.Handle("/room/", rooms)                      // /room/{name}
+	http.Handle("/rooms", MustAuth(&roomsHandler{registry: rooms}))
+	http.Handle("/rooms/", MustAuth(&roomHandler{registry: rooms})) // /rooms/{name}/members, /rooms/{name}/threads/{id}
+	http.HandleFunc("/sessions", sessionsHandler)
+	http.HandleFunc("/sessions/revoke", sessionsHandler)
+	http.HandleFunc("/notifications", notificationsHandler)
+	http.HandleFunc("/notifications/read", notificationsHandler)
+	http.Handle("/history", MustAuth(&historyHandler{store: rooms.store}))
+	http.Handle("/upload", MustAuth(&templateHandler{filename: "upload.html"})) // 아바타 사진 업로드
 	http.HandleFunc("/uploader", uploaderHandler)
-	http.Handle("/avatars/", http.StripPrefix("/avatars/", http.FileServer(http.Dir("./avatars"))))
+	// http.Handle("/avatars/", http.StripPrefix("/avatars/", http.FileServer(http.Dir(avatarsDir))))
+	http.Handle("/avatars/", newAvatarServer(avatarsDir)) // ?s=32|64|128
+	http.HandleFunc("/identicons/", identiconHandler)     // IdenticonAvatar
 
 	// ch3: logout. auth.go 에서 SetCookie 로 저장한 쿠키를 초기화한다.
 	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-		http.SetCookie(w, &http.Cookie{
-			Name:   "auth",
-			Value:  "",
-			Path:   "/",
-			MaxAge: -1,
-		})
+		// http.SetCookie(w, &http.Cookie{
+		// 	Name:   "auth",
+		// 	Value:  "",
+		// 	Path:   "/",
+		// 	MaxAge: -1,
+		// })
+		// 쿠키만 지우면 복사된 쿠키가 계속 유효하므로 서버의 세션도 끝낸다.
+		if sess, err := currentSession(r); err == nil {
+			sessions.Revoke(sess.ID)
+		}
+		clearAuthCookie(w)
 		w.Header().Set("Location", "/chat")
 		w.WriteHeader(http.StatusTemporaryRedirect)
 	})
 
 	// get the room going
 	// 룸을 실행. 무한 루프를 돌면서 상에 따라 select 구문을 실행함
-	go r.run()
+	// go r.run() // registry 가 첫 클라이언트 입장시 실행한다.
 
 	// start the web server
-	log.Println("String web server on", *addr)
-	if err := http.ListenAndServe(*addr, nil); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	log.Println("String web server on", cfg.Host)
+	// if err := http.ListenAndServe(*addr, nil); err != nil {
+	// 	log.Fatal("ListenAndServe:", err)
+	// }
+	// SIGINT/SIGTERM 을 받으면 룸을 정리하고 종료한다.
+	server := &http.Server{Addr: cfg.Host}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe:", err)
+		}
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down web server")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := rooms.Shutdown(ctx, "server restarting"); err != nil {
+		log.Println("Some clients did not leave in time:", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown:", err)
+	}
+	if closer, ok := rooms.store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Println("Failed to close history:", err)
+		}
+	}
+	if err := notifications.Close(); err != nil {
+		log.Println("Failed to save notifications:", err)
+	}
+	if err := users.Close(); err != nil {
+		log.Println("Failed to save users:", err)
+	}
+	if err := moderation.Close(); err != nil {
+		log.Println("Failed to save moderation state:", err)
 	}
 	// 하드코딩된 앱 주소를 flag 로 변경함
 	// if err := http.ListenAndServe(":8080", nil); err != nil {
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// span types of rich text (parseMarkdown)
+const (
+	spanText      = "text"
+	spanBold      = "bold"
+	spanItalic    = "italic"
+	spanCode      = "code"
+	spanCodeBlock = "codeblock"
+	spanLink      = "link"
+	spanMention   = "mention"
+	spanRoom      = "room"
+)
+
+const (
+	// maxSpanDepth is how deep bold, italics and links can be nested.
+	maxSpanDepth = 4
+	// maxMentionLength is the longest name an @mention can have.
+	maxMentionLength = 64
+	// maxURLLength is the longest URL a link can have.
+	maxURLLength = 2048
+)
+
+// span is a piece of rich text. Text, code, code blocks, mentions and
+// rooms have their text in Text; bold, italics and links have Children.
+// Clients must insert Text as text, never as HTML, and may only use
+// URL as the href of a link, so nothing a user writes becomes markup.
+type span struct {
+	Type     string
+	Text     string `json:",omitempty"`
+	URL      string `json:",omitempty"` // link
+	Lang     string `json:",omitempty"` // codeblock
+	Children []span `json:",omitempty"`
+}
+
+// fenceLangPattern is what can follow the ``` opening a code block.
+var fenceLangPattern = regexp.MustCompile(`^[a-zA-Z0-9_+#.-]{0,20}$`)
+
+// parseMarkdown parses the restricted Markdown of chat messages:
+// **bold** or __bold__, *italics* or _italics_, `code`, ``` fenced code
+// blocks, [links](https://...), bare http(s) URLs, @mentions and #room
+// references. A backslash makes the next markup character plain text.
+// Everything else, HTML included, is plain text. It returns nil if
+// text has no markup, in which case clients just show Message.
+func parseMarkdown(text string) []span {
+	var spans []span
+	var para strings.Builder
+	flush := func(block bool) {
+		s := para.String()
+		if block {
+			// 코드 블록 앞의 줄바꿈은 블록이 대신한다.
+			s = strings.TrimSuffix(s, "\n")
+		}
+		spans = append(spans, parseInline(s, 0, false)...)
+		para.Reset()
+	}
+	lines := strings.SplitAfter(text, "\n")
+	unclosed := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		lang := strings.TrimSpace(strings.TrimPrefix(line, "```"))
+		if unclosed || !strings.HasPrefix(line, "```") || !fenceLangPattern.MatchString(lang) {
+			para.WriteString(line)
+			continue
+		}
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimRight(lines[j], " \t\r\n") == "```" {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			// 닫는 줄이 없으면 뒤의 ``` 도 마찬가지다.
+			unclosed = true
+			para.WriteString(line)
+			continue
+		}
+		flush(true)
+		code := strings.TrimSuffix(strings.Join(lines[i+1:end], ""), "\n")
+		spans = append(spans, span{Type: spanCodeBlock, Text: code, Lang: lang})
+		i = end
+	}
+	flush(false)
+	if len(spans) == 0 || len(spans) == 1 && spans[0].Type == spanText {
+		return nil
+	}
+	return spans
+}
+
+// inlineParser parses the markup inside a paragraph.
+type inlineParser struct {
+	s      string
+	depth  int
+	inLink bool
+	spans  []span
+	// start is where the text not yet added to spans begins.
+	start int
+	// noCloser remembers from where a delimiter has no closer, so text
+	// full of unmatched delimiters is not searched again and again.
+	noCloser map[string]int
+}
+
+func parseInline(s string, depth int, inLink bool) []span {
+	p := &inlineParser{s: s, depth: depth, inLink: inLink, noCloser: make(map[string]int)}
+	p.parse()
+	return p.spans
+}
+
+func (p *inlineParser) parse() {
+	s := p.s
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()#@", s[i+1]) >= 0:
+			p.text(i)
+			p.start = i + 1
+			i += 2
+		case c == '`':
+			n := runLength(s[i:], '`')
+			if end := p.closingRun(i+n, n); end > i+n {
+				p.add(i, end+n, span{Type: spanCode, Text: s[i+n : end]})
+				i = end + n
+				continue
+			}
+			i += n
+		case (c == '*' || c == '_') && p.depth < maxSpanDepth:
+			n := runLength(s[i:], c)
+			if n > 2 {
+				i += n
+				continue
+			}
+			if end := p.closer(i, n, c); end >= 0 {
+				kind := spanItalic
+				if n == 2 {
+					kind = spanBold
+				}
+				p.add(i, end+n, span{Type: kind, Children: parseInline(s[i+n:end], p.depth+1, p.inLink)})
+				i = end + n
+				continue
+			}
+			i += n
+		case c == '[' && !p.inLink && p.depth < maxSpanDepth:
+			if label, href, end, ok := parseLink(s, i); ok {
+				p.add(i, end, span{Type: spanLink, URL: href, Children: parseInline(label, p.depth+1, true)})
+				i = end
+				continue
+			}
+			i++
+		case c == 'h' && !p.inLink && wordStart(s, i) && (strings.HasPrefix(s[i:], "http://") || strings.HasPrefix(s[i:], "https://")):
+			raw := bareURL(s[i:])
+			if href, ok := safeURL(raw); ok {
+				p.add(i, i+len(raw), span{Type: spanLink, URL: href, Children: []span{{Type: spanText, Text: raw}}})
+				i += len(raw)
+				continue
+			}
+			i++
+		case c == '@' && !p.inLink && wordStart(s, i):
+			name := mentionName(s[i+1:])
+			if name != "" {
+				p.add(i, i+1+len(name), span{Type: spanMention, Text: name})
+				i += 1 + len(name)
+				continue
+			}
+			i++
+		case c == '#' && !p.inLink && wordStart(s, i):
+			name := roomReference(s[i+1:])
+			if name != "" {
+				p.add(i, i+1+len(name), span{Type: spanRoom, Text: name})
+				i += 1 + len(name)
+				continue
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	p.text(len(s))
+}
+
+// text adds the plain text before end.
+func (p *inlineParser) text(end int) {
+	if end <= p.start {
+		return
+	}
+	text := p.s[p.start:end]
+	if last := len(p.spans) - 1; last >= 0 && p.spans[last].Type == spanText {
+		p.spans[last].Text += text
+	} else {
+		p.spans = append(p.spans, span{Type: spanText, Text: text})
+	}
+	p.start = end
+}
+
+// add adds the plain text before begin and then sp, which ends at end.
+func (p *inlineParser) add(begin, end int, sp span) {
+	p.text(begin)
+	p.spans = append(p.spans, sp)
+	p.start = end
+}
+
+// closingRun returns where the next run of exactly n backticks from
+// begin starts, or -1.
+func (p *inlineParser) closingRun(begin, n int) int {
+	key := strings.Repeat("`", n)
+	if from, ok := p.noCloser[key]; ok && begin >= from {
+		return -1
+	}
+	for j := begin; j < len(p.s); {
+		if p.s[j] != '`' {
+			j++
+			continue
+		}
+		m := runLength(p.s[j:], '`')
+		if m == n {
+			return j
+		}
+		j += m
+	}
+	p.noCloser[key] = begin
+	return -1
+}
+
+// closer returns where the delimiter of n c's at i is closed, or -1.
+// Like Markdown, a delimiter opens before a non-space and closes after
+// one, and _ does not work inside words, e.g. snake_case_names.
+func (p *inlineParser) closer(i, n int, c byte) int {
+	s := p.s
+	begin := i + n
+	if begin >= len(s) || isSpace(s, begin) || c == '_' && !wordStart(s, i) {
+		return -1
+	}
+	key := s[i:begin]
+	if from, ok := p.noCloser[key]; ok && begin >= from {
+		return -1
+	}
+	for j := begin + 1; j < len(s); {
+		switch s[j] {
+		case '\\':
+			j += 2
+			continue
+		case '`':
+			// 코드 안의 * 와 _ 는 닫는 기호가 아니다.
+			m := runLength(s[j:], '`')
+			if end := p.closingRun(j+m, m); end > j+m {
+				j = end + m
+			} else {
+				j += m
+			}
+			continue
+		case c:
+			m := runLength(s[j:], c)
+			if m == n && !isSpaceBefore(s, j) && (c != '_' || !isWordAt(s, j+m)) {
+				return j
+			}
+			j += m
+			continue
+		}
+		j++
+	}
+	p.noCloser[key] = begin
+	return -1
+}
+
+// parseLink parses [label](url) at i. It returns the label, the safe
+// URL and where the link ends.
+func parseLink(s string, i int) (label, href string, end int, ok bool) {
+	close := strings.IndexByte(s[i+1:], ']')
+	if close <= 0 {
+		return "", "", 0, false
+	}
+	close += i + 1
+	if close+1 >= len(s) || s[close+1] != '(' {
+		return "", "", 0, false
+	}
+	paren := strings.IndexByte(s[close+2:], ')')
+	if paren < 0 {
+		return "", "", 0, false
+	}
+	paren += close + 2
+	href, ok = safeURL(s[close+2 : paren])
+	if !ok {
+		return "", "", 0, false
+	}
+	return s[i+1 : close], href, paren + 1, true
+}
+
+// safeURL checks that raw is an absolute http, https or mailto URL and
+// returns it normalized. Other schemes, javascript: in particular, are
+// never links.
+func safeURL(raw string) (string, bool) {
+	if raw == "" || len(raw) > maxURLLength || strings.ContainsAny(raw, " \t\r\n<>\"'`\\") {
+		return "", false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" || u.Opaque != "" {
+			return "", false
+		}
+	case "mailto":
+		if u.Opaque == "" {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	return u.String(), true
+}
+
+// bareURL returns the URL at the start of s, up to a space, without the
+// punctuation that usually ends a sentence.
+func bareURL(s string) string {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '<' || r == '>'
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.TrimRight(s[:end], ".,;:!?)]*_'\"")
+}
+
+// mentionName returns the user name at the start of s, e.g. "alice"
+// for "@alice, hi", or "".
+func mentionName(s string) string {
+	end := 0
+	for end < len(s) && isNameByte(s[end]) {
+		end++
+	}
+	if end > maxMentionLength {
+		return ""
+	}
+	return strings.TrimRight(s[:end], ".-")
+}
+
+// roomReference returns the room name at the start of s, or "" if
+// there is none or it is too long for a room.
+func roomReference(s string) string {
+	end := 0
+	for end < len(s) && (isNameByte(s[end]) && s[end] != '.') {
+		end++
+	}
+	name := strings.TrimRight(s[:end], "-")
+	if !validRoomName(name) {
+		return ""
+	}
+	return name
+}
+
+func isNameByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+// wordStart reports whether i is not in the middle of a word.
+func wordStart(s string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return !isWord(r)
+}
+
+// isWordAt reports whether a letter, digit or _ starts at i.
+func isWordAt(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return isWord(r)
+}
+
+func isWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isSpace(s string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return unicode.IsSpace(r)
+}
+
+func isSpaceBefore(s string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return unicode.IsSpace(r)
+}
+
+func runLength(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
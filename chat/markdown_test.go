@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func plainSpan(s string) span { return span{Type: spanText, Text: s} }
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []span
+	}{
+		{"just text", nil},
+		{"<script>alert(1)</script>", nil},
+		{"**bold** and *it*", []span{{Type: spanBold, Children: []span{plainSpan("bold")}}, plainSpan(" and "), {Type: spanItalic, Children: []span{plainSpan("it")}}}},
+		{"__bold _both_ __", []span{plainSpan("__bold "), {Type: spanItalic, Children: []span{plainSpan("both")}}, plainSpan(" __")}},
+		{"snake_case_name", nil},
+		{"2 * 3 * 4", nil},
+		{"`a *b*` c", []span{{Type: spanCode, Text: "a *b*"}, plainSpan(" c")}},
+		{"``x ` y``", []span{{Type: spanCode, Text: "x ` y"}}},
+		{"\\*not\\* italic", nil},
+		{"see [docs](https://example.com/a?b=c)", []span{plainSpan("see "), {Type: spanLink, URL: "https://example.com/a?b=c", Children: []span{plainSpan("docs")}}}},
+		{"[x](javascript:alert(1))", nil},
+		{"[**x**](http://example.com)", []span{{Type: spanLink, URL: "http://example.com", Children: []span{{Type: spanBold, Children: []span{plainSpan("x")}}}}}},
+		{"go to https://example.com/x.", []span{plainSpan("go to "), {Type: spanLink, URL: "https://example.com/x", Children: []span{plainSpan("https://example.com/x")}}, plainSpan(".")}},
+		{"hi @alice.", []span{plainSpan("hi "), {Type: spanMention, Text: "alice"}, plainSpan(".")}},
+		{"mail bob@example.com", nil},
+		{"join #dev-ops!", []span{plainSpan("join "), {Type: spanRoom, Text: "dev-ops"}, plainSpan("!")}},
+		{"#" + strings.Repeat("r", 33), nil},
+		{"look:\n```go\nfmt.Println(\"*hi*\")\n```\ndone", []span{plainSpan("look:"), {Type: spanCodeBlock, Lang: "go", Text: "fmt.Println(\"*hi*\")"}, plainSpan("done")}},
+		{"```\nnot closed", nil},
+	}
+	for _, test := range tests {
+		if got := parseMarkdown(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseMarkdown(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func FuzzParseMarkdown(f *testing.F) {
+	for _, seed := range []string{
+		"**bold** _it_ `code`", "[a](https://b.c) @d #e", "```js\nx\n```", "***__**`", "[x](javascript:y)",
+		"\\*a* _b__ **c*", "http://[::1]:80/ <a href=x>", strings.Repeat("*a ", 100), strings.Repeat("[`", 100),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		spans := parseMarkdown(in)
+		var check func(spans []span, depth int)
+		check = func(spans []span, depth int) {
+			if depth > maxSpanDepth+1 {
+				t.Fatalf("spans nested %d deep for %q", depth, in)
+			}
+			for _, sp := range spans {
+				switch sp.Type {
+				case spanText, spanCode, spanMention, spanRoom:
+					if sp.Text == "" {
+						t.Errorf("empty %s span for %q", sp.Type, in)
+					}
+				case spanLink:
+					if href, ok := safeURL(sp.URL); !ok || href != sp.URL {
+						t.Errorf("unsafe link %q for %q", sp.URL, in)
+					}
+				case spanBold, spanItalic, spanCodeBlock:
+				default:
+					t.Errorf("unknown span %q for %q", sp.Type, in)
+				}
+				if utf8.ValidString(in) && !utf8.ValidString(sp.Text) {
+					t.Errorf("invalid UTF-8 in %+v for %q", sp, in)
+				}
+				// 역슬래시 이스케이프만 빠질 뿐, 글자는 모두 입력에서 온다.
+				if !strings.Contains(strings.Replace(in, "\\", "", -1), strings.Replace(sp.Text, "\\", "", -1)) {
+					t.Errorf("text %q is not from %q", sp.Text, in)
+				}
+				check(sp.Children, depth+1)
+			}
+		}
+		check(spans, 1)
+	})
+}
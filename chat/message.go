@@ -1,11 +1,229 @@
 package main
 
-import "time"
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// protocolVersion is the version of the message envelope.
+// The envelope is described in protocol.schema.json.
+const protocolVersion = 1
+
+// message types. Frames without a Type are chat messages, which is
+// what the first version of the client sent.
+const (
+	typeChat         = "chat"
+	typeDirect       = "direct"
+	typeJoin         = "join"
+	typeLeave        = "leave"
+	typeIdle         = "idle"
+	typeActive       = "active"
+	typeTyping       = "typing"
+	typeEdit         = "edit"
+	typeDelete       = "delete"
+	typeReaction     = "reaction"
+	typeModerate     = "moderate"
+	typeThread       = "thread"
+	typeNotification = "notification"
+	typeSystem       = "system"
+	typeError        = "error"
+)
+
+// inboundTypes are the types clients are allowed to send.
+// join, leave, idle, active, thread, notification, system and error are
+// only ever sent by the server.
+var inboundTypes = map[string]bool{
+	typeChat:     true,
+	typeDirect:   true,
+	typeTyping:   true,
+	typeEdit:     true,
+	typeDelete:   true,
+	typeReaction: true,
+	typeModerate: true,
+}
+
+const (
+	maxMessageLength = 4000
+	maxEmojiLength   = 32
+	maxKeyLength     = 64
+)
 
 // message represents a single message
 type message struct {
+	// V is the protocol version and Type the kind of event.
+	V    int
+	Type string
+
+	// ID is assigned by the server to every message. It is unique
+	// across rooms and servers.
+	ID string
+
+	// Seq is the position of a stored message in the history of its
+	// room, counting up from 1. It is what clients resume from.
+	// Servers sharing a broker get it from the broker, so it is the
+	// same on all of them.
+	Seq int64 `json:",omitempty"`
+
+	// Key is chosen by the client for a chat message so that sending it
+	// again, e.g. after a reconnect, does not post it twice.
+	Key string `json:",omitempty"`
+
 	Name      string
 	Message   string
 	When      time.Time
 	AvatarURL string
+
+	// Rich is Message parsed as restricted Markdown (markdown.go). The
+	// server sets it on chat, direct and edit messages with markup.
+	Rich []span `json:",omitempty"`
+
+	// Origin is the node the message was first received on.
+	Origin string `json:",omitempty"`
+
+	// UserID is the UniqueID of the sender, set by the server.
+	UserID string `json:",omitempty"`
+
+	// To is the UniqueID of the recipient of a direct message.
+	To string `json:",omitempty"`
+
+	// Target is the ID of the message an edit, delete or reaction is about.
+	Target string `json:",omitempty"`
+
+	// Emoji is the reaction; Remove takes it back.
+	Emoji  string `json:",omitempty"`
+	Remove bool   `json:",omitempty"`
+
+	// Edited is when a chat message was last edited, and Reactions the
+	// UniqueIDs of the users who reacted with each emoji. They are set
+	// on messages from the history (edit.go).
+	Edited    *time.Time          `json:",omitempty"`
+	Reactions map[string][]string `json:",omitempty"`
+
+	// Parent is the ID of the message a chat message replies to. Replies
+	// and LastReply summarize the thread of a message (thread.go).
+	Parent    string     `json:",omitempty"`
+	Replies   int        `json:",omitempty"`
+	LastReply *time.Time `json:",omitempty"`
+
+	// Action is what a moderate frame does (moderation.go), Role the
+	// role it gives and Duration how long a mute lasts, e.g. "10m".
+	Action   string `json:",omitempty"`
+	Role     string `json:",omitempty"`
+	Duration string `json:",omitempty"`
+
+	// Room is the room of the message a notification is about.
+	Room string `json:",omitempty"`
+
+	// to limits delivery to a single client, e.g. for error frames.
+	to *client
+	// from is the client a frame was received from.
+	from *client
+	// mentions are the UniqueIDs of the users a chat message mentions
+	// (notification.go).
+	mentions []string
+}
+
+// isChat reports whether msg is a chat message.
+func (m *message) isChat() bool {
+	return m.Type == "" || m.Type == typeChat
+}
+
+// inHistory reports whether msg is kept in the history of the room:
+// chat messages and the changes made to them.
+func (m *message) inHistory() bool {
+	switch m.Type {
+	case typeEdit, typeDelete, typeReaction:
+		return true
+	}
+	return m.isChat()
+}
+
+// validate checks a message received from a client and fills in
+// the defaults of older clients.
+func (m *message) validate() error {
+	if m.V == 0 {
+		m.V = protocolVersion
+	}
+	if m.V > protocolVersion {
+		return fmt.Errorf("unsupported protocol version %d", m.V)
+	}
+	if m.Type == "" {
+		m.Type = typeChat
+	}
+	if !inboundTypes[m.Type] {
+		return fmt.Errorf("unsupported message type %q", m.Type)
+	}
+	if m.Action != "" && m.Type != typeModerate {
+		return errors.New("only moderate frames have an Action")
+	}
+	if utf8.RuneCountInString(m.Message) > maxMessageLength {
+		return errors.New("message too long")
+	}
+	if len(m.Key) > maxKeyLength {
+		return errors.New("key too long")
+	}
+	if m.Parent != "" && m.Type != typeChat {
+		return errors.New("only chat messages can reply")
+	}
+	if len(m.Parent) > maxKeyLength {
+		return errors.New("parent too long")
+	}
+	switch m.Type {
+	case typeChat:
+		if m.Message == "" {
+			return errors.New("empty message")
+		}
+	case typeDirect:
+		if m.To == "" || m.Message == "" {
+			return errors.New("direct message needs a To and a Message")
+		}
+	case typeEdit:
+		if m.Target == "" || m.Message == "" {
+			return errors.New("edit needs a Target and a Message")
+		}
+	case typeDelete:
+		if m.Target == "" {
+			return errors.New("delete needs a Target")
+		}
+	case typeReaction:
+		if m.Target == "" || m.Emoji == "" {
+			return errors.New("reaction needs a Target and an Emoji")
+		}
+		if utf8.RuneCountInString(m.Emoji) > maxEmojiLength {
+			return errors.New("emoji too long")
+		}
+	case typeModerate:
+		return m.validateModerate()
+	}
+	return nil
+}
+
+// newMessageID returns a random ID for a message.
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// keyedMessageID returns the ID of the message the user sent with the
+// given idempotency key. It is always the same for the same user and key,
+// so a message sent again is recognized, and different users' keys
+// cannot collide.
+func keyedMessageID(userID, key string) string {
+	sum := sha256.Sum256([]byte(userID + "\x00" + key))
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// systemMessage makes a notice from the server.
+func systemMessage(text string) *message {
+	return &message{V: protocolVersion, Type: typeSystem, Name: "system", Message: text, When: time.Now()}
+}
+
+// errorMessage makes an error frame for a single client.
+func errorMessage(to *client, err error) *message {
+	return &message{V: protocolVersion, Type: typeError, Message: err.Error(), When: time.Now(), to: to}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMessageValidate(t *testing.T) {
+	// frames of the first client have no V or Type
+	old := &message{Message: "hello"}
+	if err := old.validate(); err != nil {
+		t.Errorf("validate should accept an old style chat message: %s", err)
+	}
+	if old.Type != typeChat || old.V != protocolVersion {
+		t.Errorf("validate should default to a v%d chat message, got v%d %q", protocolVersion, old.V, old.Type)
+	}
+
+	valid := []*message{
+		{Type: typeChat, Message: "hello"},
+		{Type: typeChat, Message: "hello", Parent: "abc"},
+		{Type: typeTyping},
+		{Type: typeEdit, Target: "abc", Message: "hi"},
+		{Type: typeDelete, Target: "abc"},
+		{Type: typeReaction, Target: "abc", Emoji: "👍"},
+		{Type: typeModerate, Action: actionMute, Target: "abc", Duration: "5m"},
+		{Type: typeModerate, Action: actionRole, Target: "abc", Role: "moderator"},
+	}
+	for _, msg := range valid {
+		if err := msg.validate(); err != nil {
+			t.Errorf("validate should accept %+v: %s", msg, err)
+		}
+	}
+
+	invalid := []*message{
+		{Type: typeChat},
+		{Type: typeSystem, Message: "fake notice"},
+		{Type: typeJoin},
+		{Type: "nonsense"},
+		{V: protocolVersion + 1, Message: "hello"},
+		{Type: typeEdit, Message: "hi"},
+		{Type: typeDelete},
+		{Type: typeReaction, Target: "abc"},
+		{Type: typeModerate, Action: "explode", Target: "abc"},
+		{Type: typeModerate, Action: actionKick},
+		{Type: typeModerate, Action: actionMute, Target: "abc", Duration: "1000h"},
+		{Type: typeModerate, Action: actionRole, Target: "abc", Role: "king"},
+		{Type: typeDelete, Target: "abc", Action: actionDelete},
+		{Type: typeChat, Message: "hi", Key: strings.Repeat("k", maxKeyLength+1)},
+		{Type: typeEdit, Target: "abc", Message: "hi", Parent: "abc"},
+		{Type: typeChat, Message: "hi", Parent: strings.Repeat("p", 65)},
+	}
+	for _, msg := range invalid {
+		if err := msg.validate(); err == nil {
+			t.Errorf("validate should reject %+v", msg)
+		}
+	}
+}
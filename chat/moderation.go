@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrNotAllowed is returned when a user's role in the room does not
+	// allow a moderation action.
+	ErrNotAllowed = errors.New("chat: not allowed in this room")
+	// ErrReadOnly is returned when a guest tries to write to a room.
+	ErrReadOnly = errors.New("chat: guests can only read this room")
+	// ErrMuted is returned when a muted user tries to write to a room.
+	ErrMuted = errors.New("chat: you are muted in this room")
+)
+
+// role is what a user may do in a room. Higher roles may do
+// everything the lower ones may.
+type role int
+
+const (
+	// roleGuest can only read.
+	roleGuest role = iota
+	roleMember
+	// roleModerator can kick, ban, mute and delete messages.
+	roleModerator
+	// roleOwner can also give roles.
+	roleOwner
+)
+
+var roleNames = map[role]string{
+	roleGuest:     "guest",
+	roleMember:    "member",
+	roleModerator: "moderator",
+	roleOwner:     "owner",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(s string) (role, error) {
+	for r, name := range roleNames {
+		if name == s {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("chat: unknown role %q", s)
+}
+
+// MarshalText writes roles by name in the moderation file.
+func (r role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText is ...
+func (r *role) UnmarshalText(b []byte) error {
+	var err error
+	*r, err = parseRole(string(b))
+	return err
+}
+
+// moderation actions, the Action of a moderate frame. Target is the
+// UniqueID of the user, or the ID of the message for delete.
+const (
+	actionKick   = "kick"
+	actionBan    = "ban"
+	actionUnban  = "unban"
+	actionMute   = "mute"
+	actionUnmute = "unmute"
+	actionDelete = "delete"
+	actionRole   = "role"
+)
+
+// actionRoles is the lowest role allowed to take each action.
+var actionRoles = map[string]role{
+	actionKick:   roleModerator,
+	actionBan:    roleModerator,
+	actionUnban:  roleModerator,
+	actionMute:   roleModerator,
+	actionUnmute: roleModerator,
+	actionDelete: roleModerator,
+	actionRole:   roleOwner,
+}
+
+// actionNotices are told to the room after each action.
+var actionNotices = map[string]string{
+	actionKick:   "was kicked",
+	actionBan:    "was banned",
+	actionUnban:  "was unbanned",
+	actionMute:   "was muted",
+	actionUnmute: "was unmuted",
+	actionRole:   "is now a",
+}
+
+const (
+	// defaultMute is how long a mute lasts when no Duration is given.
+	defaultMute = 10 * time.Minute
+	// maxMute is the longest mute; longer ones should be bans.
+	maxMute = 7 * 24 * time.Hour
+	// moderationSaveDelay is how long changes wait to be saved.
+	moderationSaveDelay = time.Second
+)
+
+// validateModerate checks a moderate frame received from a client.
+func (m *message) validateModerate() error {
+	if _, ok := actionRoles[m.Action]; !ok {
+		return fmt.Errorf("unknown moderation action %q", m.Action)
+	}
+	if m.Target == "" {
+		return errors.New("moderate needs a Target")
+	}
+	switch m.Action {
+	case actionMute:
+		if m.Duration != "" {
+			if d, err := time.ParseDuration(m.Duration); err != nil || d <= 0 || d > maxMute {
+				return fmt.Errorf("mute duration must be between 0 and %s", maxMute)
+			}
+		}
+	case actionRole:
+		if _, err := parseRole(m.Role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// muteDuration is how long the mute of msg lasts.
+func (m *message) muteDuration() time.Duration {
+	if d, err := time.ParseDuration(m.Duration); err == nil {
+		return d
+	}
+	return defaultMute
+}
+
+// ban records who banned a user and why.
+type ban struct {
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	When   time.Time `json:"when"`
+}
+
+// roomModeration is the moderation state of a room, by UniqueID.
+type roomModeration struct {
+	Roles map[string]role      `json:"roles,omitempty"`
+	Bans  map[string]ban       `json:"bans,omitempty"`
+	Mutes map[string]time.Time `json:"mutes,omitempty"`
+}
+
+// auditEntry is a line of the audit log, written for every action.
+type auditEntry struct {
+	When   time.Time `json:"when"`
+	Room   string    `json:"room"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// moderationStore keeps the roles, bans and mutes of every room and
+// writes the audit log. It is used from the run loops of all rooms and
+// from the websocket handlers, so it has its own lock. The file and
+// the audit log are written in the background, so rooms never wait for
+// the disk; Close writes what is left.
+type moderationStore struct {
+	mu    sync.Mutex
+	rooms map[string]*roomModeration
+	// owners own every room, e.g. the admins of the server.
+	owners map[string]bool
+	// defaultRole is the role of users that were given none.
+	defaultRole role
+	// saver saves the rooms to a file; nil keeps them in memory.
+	saver *saver
+	// audit receives an auditEntry as a JSON line for every action.
+	// The lines wait in auditLines until auditor writes them.
+	audit      io.Writer
+	auditLines [][]byte
+	auditor    *saver
+	now        func() time.Time
+}
+
+// moderation is the moderation state shared by all rooms. It is set up in main.
+var moderation = newModerationStore()
+
+func newModerationStore() *moderationStore {
+	s := &moderationStore{
+		rooms:       make(map[string]*roomModeration),
+		owners:      make(map[string]bool),
+		defaultRole: roleMember,
+		audit:       ioutil.Discard,
+		now:         time.Now,
+	}
+	s.auditor = newSaver(0, s.writeAudit)
+	return s
+}
+
+// openModerationStore loads the moderation state saved in filename,
+// if any, and saves every change back to it until Close is called.
+func openModerationStore(filename string) (*moderationStore, error) {
+	s := newModerationStore()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.rooms); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	s.saver = newFileSaver(filename, moderationSaveDelay, func() ([]byte, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return json.Marshal(s.rooms)
+	})
+	return s, nil
+}
+
+// Close stops writing in the background and writes the audit log and
+// the file one last time.
+func (s *moderationStore) Close() error {
+	auditErr := s.auditor.Close()
+	if err := s.saver.Close(); err != nil {
+		return err
+	}
+	return auditErr
+}
+
+// writeAudit writes the waiting audit lines to the audit log.
+func (s *moderationStore) writeAudit() error {
+	s.mu.Lock()
+	lines, w := s.auditLines, s.audit
+	s.auditLines = nil
+	s.mu.Unlock()
+	for _, line := range lines {
+		if _, err := w.Write(line); err != nil {
+			return fmt.Errorf("chat: failed to write audit log: %s", err)
+		}
+	}
+	return nil
+}
+
+// room returns the state of the named room, creating it. s.mu must be held.
+func (s *moderationStore) room(name string) *roomModeration {
+	rm, ok := s.rooms[name]
+	if !ok {
+		rm = &roomModeration{}
+		s.rooms[name] = rm
+	}
+	// 파일에서 읽은 룸은 비어 있던 map 이 nil 이다. (omitempty)
+	if rm.Roles == nil {
+		rm.Roles = make(map[string]role)
+	}
+	if rm.Bans == nil {
+		rm.Bans = make(map[string]ban)
+	}
+	if rm.Mutes == nil {
+		rm.Mutes = make(map[string]time.Time)
+	}
+	return rm
+}
+
+// roleOf returns the role of the user in the room. s.mu must be held.
+func (s *moderationStore) roleOf(room, userID string) role {
+	if s.owners[userID] {
+		return roleOwner
+	}
+	if r, ok := s.rooms[room].roles()[userID]; ok {
+		return r
+	}
+	return s.defaultRole
+}
+
+// roles is nil safe so unknown rooms need not be created to be read.
+func (rm *roomModeration) roles() map[string]role {
+	if rm == nil {
+		return nil
+	}
+	return rm.Roles
+}
+
+// role returns the role of the user in the room.
+func (s *moderationStore) role(room, userID string) role {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roleOf(room, userID)
+}
+
+// banned reports whether the user is banned from the room.
+func (s *moderationStore) banned(room, userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rm, ok := s.rooms[room]
+	if !ok {
+		return false
+	}
+	_, banned := rm.Bans[userID]
+	return banned
+}
+
+// refuseBanned answers the request and returns true if its user is
+// banned from the room, for the HTTP endpoints that show a room.
+func refuseBanned(w http.ResponseWriter, req *http.Request, room string) bool {
+	sess, err := currentSession(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return true
+	}
+	if moderation.banned(room, sess.UserID) {
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// allow returns an error if the user may not write to the room.
+func (s *moderationStore) allow(room, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.roleOf(room, userID) == roleGuest {
+		return ErrReadOnly
+	}
+	rm, ok := s.rooms[room]
+	if !ok {
+		return nil
+	}
+	if until, muted := rm.Mutes[userID]; muted {
+		if s.now().Before(until) {
+			return ErrMuted
+		}
+		// 기간이 지난 mute 는 지운다.
+		delete(rm.Mutes, userID)
+		s.saver.touch()
+	}
+	return nil
+}
+
+// apply checks that the sender of the moderate frame msg may take its
+// action in the room, makes the change and records it in the audit log.
+// Users can only act on users with a lower role than their own.
+func (s *moderationStore) apply(room string, msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actor := s.roleOf(room, msg.UserID)
+	if actor < actionRoles[msg.Action] {
+		return ErrNotAllowed
+	}
+	if msg.Action != actionDelete && s.roleOf(room, msg.Target) >= actor {
+		return ErrNotAllowed
+	}
+	if msg.Action == actionRole {
+		if r, _ := parseRole(msg.Role); r > actor {
+			return ErrNotAllowed
+		}
+	}
+	entry := auditEntry{
+		When:   s.now(),
+		Room:   room,
+		Actor:  msg.UserID,
+		Action: msg.Action,
+		Target: msg.Target,
+		Detail: msg.Message,
+	}
+	switch msg.Action {
+	case actionMute:
+		entry.Detail = msg.muteDuration().String()
+	case actionRole:
+		entry.Detail = msg.Role
+	}
+	if err := s.changeLocked(room, msg); err != nil {
+		return err
+	}
+	// 감사 기록은 룸을 기다리게 하지 않도록 따로 쓴다.
+	data, _ := json.Marshal(entry)
+	s.auditLines = append(s.auditLines, append(data, '\n'))
+	s.auditor.touch()
+	return nil
+}
+
+// change makes the change of a moderate frame without checking who sent
+// it, e.g. for actions taken on another node.
+func (s *moderationStore) change(room string, msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changeLocked(room, msg)
+}
+
+func (s *moderationStore) changeLocked(room string, msg *message) error {
+	rm := s.room(room)
+	switch msg.Action {
+	case actionBan:
+		rm.Bans[msg.Target] = ban{By: msg.UserID, Reason: msg.Message, When: s.now()}
+	case actionUnban:
+		delete(rm.Bans, msg.Target)
+	case actionMute:
+		rm.Mutes[msg.Target] = s.now().Add(msg.muteDuration())
+	case actionUnmute:
+		delete(rm.Mutes, msg.Target)
+	case actionRole:
+		r, err := parseRole(msg.Role)
+		if err != nil {
+			return err
+		}
+		rm.Roles[msg.Target] = r
+	default: // kick, delete
+		return nil
+	}
+	s.saver.touch()
+	return nil
+}
+
+// moderate carries out a moderate frame sent by a client of the room.
+func (r *room) moderate(msg *message) {
+	if err := moderation.apply(r.name, msg); err != nil {
+		r.deliver(msg.from, errorMessage(msg.from, err))
+		return
+	}
+	r.tracer.Trace("Moderation: ", msg.Action, " ", msg.Target, " by ", msg.UserID)
+	// 다른 서버에 있는 같은 룸에도 알린다.
+	r.publish(msg)
+	r.enforce(msg)
+}
+
+// enforce applies a moderation action to the clients and the history
+// of the room and tells the members about it.
+func (r *room) enforce(msg *message) {
+	switch msg.Action {
+	case actionDelete:
+		deleted := &message{
+			V:      protocolVersion,
+			Type:   typeDelete,
+			Action: actionDelete,
+			Target: msg.Target,
+			Name:   msg.Name,
+			UserID: msg.UserID,
+			When:   msg.When,
+		}
+		if target, err := r.store.Lookup(r.name, msg.Target); err == nil {
+			deleted.Parent = target.Parent
+		}
+		if err := r.store.Append(r.name, deleted); err != nil {
+			r.tracer.Trace("Failed to store deletion: ", err)
+		}
+		r.broadcast(deleted, "")
+		if deleted.Parent != "" {
+			r.announceThread(deleted.Parent)
+		}
+		return
+	case actionKick, actionBan:
+		r.kick(msg.Target, "you "+actionNotices[msg.Action])
+	}
+	name := msg.Target
+	if info, ok := users.lookup(msg.Target); ok {
+		name = info.Name
+	}
+	notice := name + " " + actionNotices[msg.Action]
+	switch msg.Action {
+	case actionMute:
+		notice += " for " + msg.muteDuration().String()
+	case actionRole:
+		notice += " " + msg.Role
+	}
+	r.broadcast(systemMessage(notice+" by "+msg.Name), "")
+}
+
+// kick disconnects every client of the user from the room.
+func (r *room) kick(userID, reason string) {
+	for client, ok := range r.clients {
+		if ok && client.userID() == userID {
+			// 소켓을 닫으면 client.read() 가 끝나고 leave 로 정리된다.
+			r.clients[client] = false
+			go client.closeWith(websocket.ClosePolicyViolation, reason)
+			r.tracer.Trace("Client kicked")
+		}
+	}
+}
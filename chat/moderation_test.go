@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModerationStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moderation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "moderation.json")
+
+	s, err := openModerationStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	s.audit = &audit
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.owners["boss"] = true
+
+	act := func(actor, action, target string) *message {
+		return &message{Type: typeModerate, UserID: actor, Action: action, Target: target}
+	}
+	if err := s.apply("lobby", act("nobody", actionKick, "troll")); err != ErrNotAllowed {
+		t.Errorf("members should not kick, got %v", err)
+	}
+	promote := act("boss", actionRole, "mod")
+	promote.Role = "moderator"
+	if err := s.apply("lobby", promote); err != nil {
+		t.Fatalf("owner should give roles: %s", err)
+	}
+	if s.role("lobby", "mod") != roleModerator || s.role("kitchen", "mod") != roleMember {
+		t.Error("roles should be per room")
+	}
+	for _, msg := range []*message{act("mod", actionBan, "boss"), act("mod", actionRole, "troll")} {
+		msg.Role = "owner"
+		if err := s.apply("lobby", msg); err != ErrNotAllowed {
+			t.Errorf("moderator should not %s %s, got %v", msg.Action, msg.Target, err)
+		}
+	}
+
+	if err := s.apply("lobby", act("mod", actionBan, "troll")); err != nil {
+		t.Fatalf("moderator should ban: %s", err)
+	}
+	mute := act("mod", actionMute, "noisy")
+	mute.Duration = "1m"
+	s.apply("lobby", mute)
+	if err := s.allow("lobby", "noisy"); err != ErrMuted {
+		t.Errorf("allow should refuse a muted user, got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := s.allow("lobby", "noisy"); err != nil {
+		t.Errorf("mute should have expired, got %v", err)
+	}
+
+	// 파일과 감사 기록은 룸을 기다리게 하지 않고 나중에 쓴다.
+	if data, _ := ioutil.ReadFile(filename); len(data) != 0 {
+		t.Errorf("moderation file should be written in the background, got %s", data)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var entries []auditEntry
+	for dec := json.NewDecoder(&audit); dec.More(); {
+		var entry auditEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 || entries[1].Action != actionBan || entries[1].Actor != "mod" || entries[2].Detail != "1m0s" {
+		t.Errorf("audit log should have the 3 actions taken, got %+v", entries)
+	}
+
+	// 다시 열어도 차단과 역할이 남아 있다.
+	s, err = openModerationStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.banned("lobby", "troll") || s.banned("kitchen", "troll") || s.role("lobby", "mod") != roleModerator {
+		t.Error("bans and roles should be saved")
+	}
+	s.defaultRole = roleGuest
+	if err := s.allow("lobby", "visitor"); err != ErrReadOnly {
+		t.Errorf("allow should refuse guests, got %v", err)
+	}
+}
+
+func TestBannedUserHTTP(t *testing.T) {
+	defer func(old *moderationStore) { moderation = old }(moderation)
+	moderation = newModerationStore()
+	moderation.change("lobby", &message{Type: typeModerate, UserID: "mod", Action: actionBan, Target: "troll"})
+
+	registry := newRoomRegistry()
+	registry.store.Append("lobby", &message{Type: typeChat, ID: "root", Message: "lunch?"})
+	history := &historyHandler{store: registry.store}
+	rooms := &roomHandler{registry: registry}
+	cookies := map[string]*http.Cookie{"troll": newTestSession(t, "troll"), "bystander": newTestSession(t, "bystander")}
+	codes := map[string]int{"troll": http.StatusForbidden, "bystander": http.StatusOK}
+
+	for path, h := range map[string]http.Handler{
+		"/history?room=lobby":       history,
+		"/rooms/lobby/members":      rooms,
+		"/rooms/lobby/threads/root": rooms,
+	} {
+		for user, code := range codes {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.AddCookie(cookies[user])
+			h.ServeHTTP(w, req)
+			if w.Code != code {
+				t.Errorf("%s should get %d for %s, got %d", path, code, user, w.Code)
+			}
+			if code == http.StatusForbidden && strings.Contains(w.Body.String(), "lunch") {
+				t.Errorf("%s should not show the room to a banned user", path)
+			}
+		}
+	}
+	// 다른 룸은 그대로 볼 수 있다.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/history?room=kitchen", nil)
+	req.AddCookie(cookies["troll"])
+	history.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("user banned from lobby should read kitchen, got %d", w.Code)
+	}
+}
+
+func TestRoomModeration(t *testing.T) {
+	defer func(old *moderationStore) { moderation = old }(moderation)
+	moderation = newModerationStore()
+	moderation.owners["boss"] = true
+
+	r := newRoom()
+	r.name = "lobby"
+	go r.run()
+	defer close(r.quit)
+	boss := newTestUserClient(t, r, "boss")
+	troll := newTestUserClient(t, r, "troll")
+	bystander := newTestUserClient(t, r, "bystander")
+	r.join <- bystander
+	r.join <- boss
+	r.join <- troll
+	receive(t, bystander, 2) // joined
+
+	send := func(c *client, msg *message) {
+		msg.UserID, msg.Name, msg.from = c.userID(), c.userID(), c
+		r.forward <- msg
+	}
+	send(troll, &message{Type: typeModerate, Action: actionKick, Target: "boss"})
+	if msgs := receive(t, troll, 1); msgs[0].Type != typeError {
+		t.Errorf("troll should get an error frame, got %+v", msgs[0])
+	}
+
+	send(troll, &message{Type: typeChat, ID: "spam", Message: "buy now"})
+	receive(t, bystander, 1)
+	send(boss, &message{Type: typeModerate, Action: actionDelete, Target: "spam"})
+	if msgs := receive(t, bystander, 1); msgs[0].Type != typeDelete || msgs[0].Target != "spam" {
+		t.Errorf("room should be told the message was deleted, got %+v", msgs[0])
+	}
+	if msgs, _ := lastMessages(r.store, "lobby", 10); len(msgs) != 0 {
+		t.Errorf("deleted message should be gone from the history, got %v", msgs)
+	}
+
+	send(boss, &message{Type: typeModerate, Action: actionMute, Target: "troll"})
+	if msgs := receive(t, bystander, 1); msgs[0].Type != typeSystem {
+		t.Errorf("room should be told about the mute, got %+v", msgs[0])
+	}
+	receive(t, troll, 3) // spam, delete and mute
+	send(troll, &message{Type: typeChat, Message: "let me talk"})
+	if msgs := receive(t, troll, 1); msgs[0].Type != typeError || msgs[0].Message != ErrMuted.Error() {
+		t.Errorf("muted user should get an error frame, got %+v", msgs[0])
+	}
+
+	send(boss, &message{Type: typeModerate, Action: actionBan, Target: "troll"})
+	waitForRoom(r)
+	if _, _, err := troll.socket.ReadMessage(); err == nil {
+		t.Error("banned user's socket should be closed")
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/room/lobby", nil)
+	req.AddCookie(newTestSession(t, "troll"))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("banned user should not get a socket, got %d", w.Code)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxInbox is how many notifications a user keeps. Older ones are dropped.
+	maxInbox = 200
+	// maxMentions is how many users a single message can notify.
+	maxMentions = 20
+	// excerptLength is how much of the message a notification quotes.
+	excerptLength = 140
+	// notificationSaveDelay is how long changes to the inboxes wait to
+	// be saved together.
+	notificationSaveDelay = time.Second
+)
+
+// notification is an entry in the inbox of a user, e.g. for a message
+// that mentioned them.
+type notification struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"` // "mention"
+	Room      string    `json:"room"`
+	MessageID string    `json:"message_id"`
+	From      string    `json:"from"`
+	Name      string    `json:"name"`
+	AvatarURL string    `json:"avatar_url"`
+	Excerpt   string    `json:"excerpt"`
+	When      time.Time `json:"when"`
+	Read      bool      `json:"read"`
+}
+
+// message makes the notification event pushed to the sockets of the user.
+func (n *notification) message() *message {
+	return &message{
+		V:         protocolVersion,
+		Type:      typeNotification,
+		ID:        n.ID,
+		Target:    n.MessageID,
+		Room:      n.Room,
+		UserID:    n.From,
+		Name:      n.Name,
+		AvatarURL: n.AvatarURL,
+		Message:   n.Excerpt,
+		When:      n.When,
+	}
+}
+
+// notificationStore keeps the inbox of every user, oldest first, and
+// saves it to a file if it has one, so users get their notifications
+// when they come back. The file is written in the background, so rooms
+// never wait for the disk; Close saves what is left.
+type notificationStore struct {
+	mu      sync.Mutex
+	inboxes map[string][]*notification
+	saver   *saver
+}
+
+// notifications holds the inboxes of all users. It is set up in main.
+var notifications = newNotificationStore()
+
+func newNotificationStore() *notificationStore {
+	return &notificationStore{inboxes: make(map[string][]*notification)}
+}
+
+// openNotificationStore loads the inboxes saved in filename, if any,
+// and saves the changes back to it until Close is called.
+func openNotificationStore(filename string) (*notificationStore, error) {
+	s := newNotificationStore()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.inboxes); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	s.saver = newFileSaver(filename, notificationSaveDelay, func() ([]byte, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return json.Marshal(s.inboxes)
+	})
+	return s, nil
+}
+
+// Close stops saving changes in the background and saves the inboxes
+// one last time.
+func (s *notificationStore) Close() error {
+	return s.saver.Close()
+}
+
+// add puts n in the inbox of the user.
+func (s *notificationStore) add(userID string, n *notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inbox := append(s.inboxes[userID], n)
+	if len(inbox) > maxInbox {
+		inbox = append([]*notification(nil), inbox[len(inbox)-maxInbox:]...)
+	}
+	s.inboxes[userID] = inbox
+	s.saver.touch()
+}
+
+// list returns copies of the notifications of the user, newest first,
+// and how many are unread.
+func (s *notificationStore) list(userID string, unreadOnly bool) ([]notification, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inbox := s.inboxes[userID]
+	result := []notification{}
+	unread := 0
+	for i := len(inbox) - 1; i >= 0; i-- {
+		if !inbox[i].Read {
+			unread++
+		} else if unreadOnly {
+			continue
+		}
+		result = append(result, *inbox[i])
+	}
+	return result, unread
+}
+
+// markRead marks the notifications of the user with the given IDs read,
+// or all of them if ids is empty.
+func (s *notificationStore) markRead(userID string, ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, n := range s.inboxes[userID] {
+		if !n.Read && (len(ids) == 0 || containsString(ids, n.ID)) {
+			n.Read = true
+			changed = true
+		}
+	}
+	if changed {
+		s.saver.touch()
+	}
+}
+
+// mentioned returns the UniqueIDs of the known users mentioned in the
+// rich text of a message, except the sender. A mention is the UniqueID
+// of a user, or their display name without spaces, ignoring case.
+// Users are known once they logged in or connected (direct.go).
+func (idx *userIndex) mentioned(spans []span, from string) []string {
+	var names []string
+	var collect func(spans []span)
+	collect = func(spans []span) {
+		for _, sp := range spans {
+			if sp.Type == spanMention {
+				names = append(names, sp.Text)
+			}
+			collect(sp.Children)
+		}
+	}
+	collect(spans)
+	if len(names) == 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var ids []string
+	for _, name := range names {
+		for _, id := range idx.find(name) {
+			if id != from && !containsString(ids, id) && len(ids) < maxMentions {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// find returns the user with the UniqueID name, or else the users whose
+// display name is name. idx.mu must be held.
+func (idx *userIndex) find(name string) []string {
+	if _, ok := idx.known[name]; ok {
+		return []string{name}
+	}
+	var ids []string
+	for id, info := range idx.known {
+		if strings.EqualFold(strings.Join(strings.Fields(info.Name), ""), name) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// notifyMentions puts a notification for msg in the inbox of every user
+// it mentions who may see the room, and pushes it to their open sockets
+// in whatever room they are. Servers sharing a broker each do so for
+// the users they know, so users are notified where they are connected.
+func (r *room) notifyMentions(msg *message) {
+	for _, userID := range msg.mentions {
+		if moderation.banned(r.name, userID) {
+			continue
+		}
+		n := &notification{
+			ID:        newMessageID(),
+			Type:      "mention",
+			Room:      r.name,
+			MessageID: msg.ID,
+			From:      msg.UserID,
+			Name:      msg.Name,
+			AvatarURL: msg.AvatarURL,
+			Excerpt:   excerpt(msg.Message),
+			When:      msg.When,
+		}
+		notifications.add(userID, n)
+		for _, to := range users.sockets(userID) {
+			event := n.message()
+			event.to = to
+			if to.room == r {
+				r.deliver(to, event)
+				continue
+			}
+			// 다른 룸의 run 루프에 보내다가 서로 기다리지 않도록 따로 보낸다.
+			go to.room.send(event)
+		}
+	}
+}
+
+// excerpt shortens text to excerptLength characters.
+func excerpt(text string) string {
+	if utf8.RuneCountInString(text) <= excerptLength {
+		return text
+	}
+	return string([]rune(text)[:excerptLength-1]) + "…"
+}
+
+// notificationsHandler serves the inbox of the current user and marks
+// notifications read.
+// format: GET /notifications (unread=true for unread ones only),
+// POST /notifications/read (id={notification id}, repeated, or all=true)
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	current, err := currentSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/notifications":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list, unread := notifications.list(current.UserID, r.FormValue("unread") == "true")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Unread        int            `json:"unread"`
+			Notifications []notification `json:"notifications"`
+		}{unread, list})
+	case "/notifications/read":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.ParseForm()
+		ids := r.Form["id"]
+		if len(ids) == 0 && r.FormValue("all") != "true" {
+			http.Error(w, "id or all=true is required", http.StatusBadRequest)
+			return
+		}
+		notifications.markRead(current.UserID, ids)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotificationStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "notifications.json")
+
+	s, err := openNotificationStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		s.add("alice", &notification{ID: id, Type: "mention", Room: "lobby"})
+	}
+	// 룸이 디스크를 기다리지 않도록 저장은 나중에 한번에 한다.
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("add should leave saving to the background, got %v", err)
+	}
+	s.markRead("alice", []string{"n2"})
+	list, unread := s.list("alice", false)
+	if len(list) != 3 || unread != 2 || list[0].ID != "n3" || !list[1].Read {
+		t.Errorf("list should have the newest first and n2 read, got %+v (%d unread)", list, unread)
+	}
+	if list, _ := s.list("bob", false); len(list) != 0 {
+		t.Errorf("inboxes should be per user, got %+v", list)
+	}
+
+	// 닫을 때 남은 변경을 저장하므로 다시 열어도 알림과 읽음 표시가 남아 있다.
+	s.Close()
+	s, err = openNotificationStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, unread := s.list("alice", true); len(list) != 2 || unread != 2 || list[1].ID != "n1" {
+		t.Errorf("unread notifications should be saved, got %+v", list)
+	}
+	s.markRead("alice", nil)
+	if _, unread := s.list("alice", false); unread != 0 {
+		t.Errorf("all notifications should be read, %d are not", unread)
+	}
+
+	for i := 0; i < maxInbox+5; i++ {
+		s.add("bob", &notification{ID: string(rune('a' + i%26))})
+	}
+	if list, _ := s.list("bob", false); len(list) != maxInbox {
+		t.Errorf("inbox should keep %d notifications, got %d", maxInbox, len(list))
+	}
+	s.Close()
+}
+
+func TestMentioned(t *testing.T) {
+	idx := newUserIndex()
+	idx.remember(map[string]interface{}{"userid": "a1", "name": "Alice Smith"})
+	idx.remember(map[string]interface{}{"userid": "b2", "name": "bob"})
+	idx.remember(map[string]interface{}{"userid": "b3", "name": "Bob"})
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hi @alicesmith", []string{"a1"}},
+		{"**@a1** and @a1 again", []string{"a1"}},
+		{"@nobody there?", nil},
+		{"`@a1` in code", nil},
+		{"mail a1@example.com", nil},
+		{"hey @b2 and @me", []string{"b2"}},
+	}
+	for _, test := range tests {
+		got := idx.mentioned(parseMarkdown(test.text), "me")
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("mentioned(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+	if got := idx.mentioned(parseMarkdown("@bob"), "me"); len(got) != 2 {
+		t.Errorf("a name two users have should mention both, got %v", got)
+	}
+	if got := idx.mentioned(parseMarkdown("note to self @a1"), "a1"); len(got) != 0 {
+		t.Errorf("users should not be notified of their own mentions, got %v", got)
+	}
+}
+
+func TestRoomMentions(t *testing.T) {
+	defer func(old *userIndex) { users = old }(users)
+	defer func(old *notificationStore) { notifications = old }(notifications)
+	users = newUserIndex()
+	notifications = newNotificationStore()
+
+	r := newRoom()
+	r.name = "lobby"
+	go r.run()
+	defer close(r.quit)
+	other := newRoom()
+	other.name = "kitchen"
+	go other.run()
+	defer close(other.quit)
+	alice := newTestUserClient(t, r, "alice")
+	bob := newTestUserClient(t, r, "bob")
+	away := newTestUserClient(t, other, "alice")
+	r.join <- alice
+	r.join <- bob
+	other.join <- away
+	receive(t, alice, 1) // bob joined
+	waitForRoom(other)
+	users.remember(map[string]interface{}{"userid": "carol", "name": "carol"})
+
+	msg := &message{Type: typeChat, ID: "m1", Message: "@alice @carol lunch?", UserID: "bob", Name: "bob", When: time.Now(), from: bob}
+	msg.Rich = parseMarkdown(msg.Message)
+	msg.mentions = users.mentioned(msg.Rich, msg.UserID)
+	r.forward <- msg
+
+	msgs := receive(t, alice, 2)
+	if msgs[1].Type != typeNotification || msgs[1].Target != "m1" || msgs[1].Room != "lobby" || msgs[1].Name != "bob" {
+		t.Errorf("alice should be notified in the room, got %+v", msgs[1])
+	}
+	if msgs := receive(t, away, 1); len(msgs) != 1 || msgs[0].Type != typeNotification {
+		t.Errorf("alice should be notified in the other room, got %+v", msgs)
+	}
+	if msgs := receive(t, bob, 1); len(msgs) != 1 || msgs[0].Type != typeChat {
+		t.Errorf("bob should only get the message, got %+v", msgs)
+	}
+	waitForRoom(r)
+	if len(bob.send) != 0 {
+		t.Error("bob should not be notified")
+	}
+	if list, _ := notifications.list("carol", true); len(list) != 1 || list[0].MessageID != "m1" || list[0].Excerpt != msg.Message {
+		t.Errorf("offline carol should find the notification in her inbox, got %+v", list)
+	}
+}
+
+func TestRoomMentionsShareBroker(t *testing.T) {
+	defer func(old *notificationStore) { notifications = old }(notifications)
+	notifications = newNotificationStore()
+
+	broker := NewInProcessBroker()
+	a, b := newRoom(), newRoom()
+	a.name, b.name = "lobby", "lobby"
+	a.node, b.node = "a", "b"
+	a.broker, b.broker = broker, broker
+	go a.run()
+	go b.run()
+	defer close(a.quit)
+	defer close(b.quit)
+	// 노드 b 에만 접속한 dana
+	dana := newTestUserClient(t, b, "dana")
+	b.join <- dana
+	waitForRoom(b)
+
+	msg := &message{Type: typeChat, ID: "m2", Message: "hi @dana", UserID: "erin", Name: "erin", When: time.Now()}
+	msg.Rich = parseMarkdown(msg.Message)
+	a.forward <- msg
+
+	msgs := receive(t, dana, 2)
+	if len(msgs) != 2 || msgs[0].Type != typeChat || msgs[1].Type != typeNotification || msgs[1].Target != "m2" {
+		t.Errorf("dana should be notified on node b, got %+v", msgs)
+	}
+	if list, _ := notifications.list("dana", true); len(list) != 1 || list[0].From != "erin" {
+		t.Errorf("node b should keep the notification for dana, got %+v", list)
+	}
+}
+
+func TestNotificationsHandler(t *testing.T) {
+	defer func(old *notificationStore) { notifications = old }(notifications)
+	notifications = newNotificationStore()
+	cookie := newTestSession(t, "alice")
+	notifications.add("alice", &notification{ID: "n1", Type: "mention"})
+	notifications.add("alice", &notification{ID: "n2", Type: "mention"})
+	notifications.add("bob", &notification{ID: "n3", Type: "mention"})
+
+	do := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, path, nil)
+		}
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		notificationsHandler(w, req)
+		return w
+	}
+	inbox := func(path string) (int, []string) {
+		w := do(http.MethodGet, path, nil)
+		var resp struct {
+			Unread        int
+			Notifications []notification
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, n := range resp.Notifications {
+			ids = append(ids, n.ID)
+		}
+		return resp.Unread, ids
+	}
+
+	if unread, ids := inbox("/notifications"); unread != 2 || strings.Join(ids, ",") != "n2,n1" {
+		t.Errorf("GET should list alice's notifications, got %d unread %v", unread, ids)
+	}
+	if w := do(http.MethodPost, "/notifications/read", url.Values{"id": {"n2", "n3"}}); w.Code != http.StatusNoContent {
+		t.Errorf("POST read should succeed, got %d", w.Code)
+	}
+	if unread, ids := inbox("/notifications?unread=true"); unread != 1 || strings.Join(ids, ",") != "n1" {
+		t.Errorf("only n1 should be unread, got %d unread %v", unread, ids)
+	}
+	if _, unread := notifications.list("bob", false); unread != 1 {
+		t.Error("alice should not mark bob's notifications read")
+	}
+	if w := do(http.MethodPost, "/notifications/read", url.Values{}); w.Code != http.StatusBadRequest {
+		t.Errorf("POST read without ids should fail, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/notifications/read", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET read should not be allowed, got %d", w.Code)
+	}
+	do(http.MethodPost, "/notifications/read", url.Values{"all": {"true"}})
+	if unread, _ := inbox("/notifications"); unread != 0 {
+		t.Errorf("all should be read, %d are not", unread)
+	}
+
+	w := httptest.NewRecorder()
+	notificationsHandler(w, httptest.NewRequest(http.MethodGet, "/notifications", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous users have no inbox, got %d", w.Code)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrIDToken is returned when an ID token fails verification.
+var ErrIDToken = errors.New("chat: invalid ID token")
+
+// oidcClockSkew is tolerated between our clock and the issuer's.
+const oidcClockSkew = time.Minute
+
+// oidcDiscovery is the part of the issuer's
+// /.well-known/openid-configuration document that is used.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the ID token claims that are checked or used.
+type oidcClaims struct {
+	Issuer   string      `json:"iss"`
+	Subject  string      `json:"sub"`
+	Audience audience    `json:"aud"`
+	AZP      string      `json:"azp"`
+	Expires  json.Number `json:"exp"`
+	IssuedAt json.Number `json:"iat"`
+	Nonce    string      `json:"nonce"`
+	Name     string      `json:"name"`
+	Email    string      `json:"email"`
+	Picture  string      `json:"picture"`
+}
+
+// audience is the aud claim, which is either a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcProvider logs users in with any OpenID Connect issuer using the
+// authorization code flow with PKCE. Everything else is discovered from
+// the issuer URL.
+type oidcProvider struct {
+	name        string
+	issuer      string
+	clientID    string
+	secret      string
+	redirectURL string
+	scopes      []string
+	client      *http.Client
+	now         func() time.Time
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+// oidcProviders are the configured OpenID Connect providers by name.
+var oidcProviders = make(map[string]*oidcProvider)
+
+func newOIDCProvider(name, issuer, clientID, secret, redirectURL string) *oidcProvider {
+	return &oidcProvider{
+		name:        name,
+		issuer:      strings.TrimRight(issuer, "/"),
+		clientID:    clientID,
+		secret:      secret,
+		redirectURL: redirectURL,
+		scopes:      []string{"openid", "profile", "email"},
+		client:      &http.Client{Timeout: 10 * time.Second},
+		now:         time.Now,
+	}
+}
+
+// discover fetches the issuer's configuration once.
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = new(oidcDiscovery)
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("chat: discovery for %s: %s", p.name, err)
+	}
+	// 다른 issuer 의 설정을 받으면 안 된다.
+	if strings.TrimRight(d.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("chat: discovery for %s returned issuer %q", p.name, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("chat: discovery for %s is missing endpoints", p.name)
+	}
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+	return d, nil
+}
+
+// BeginAuth returns the issuer's login URL for the login ls, whose
+// state value is state.
+func (p *oidcProvider) BeginAuth(state string, ls *loginState) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(ls.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.redirectURL},
+		"scope":                 {strings.Join(p.scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {ls.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// CompleteAuth redeems the code of the callback of the login ls, whose
+// state was already checked by loginStates, and verifies the ID token.
+func (p *oidcProvider) CompleteAuth(query url.Values, ls *loginState) (*oidcUser, error) {
+	if e := query.Get("error"); e != "" {
+		return nil, fmt.Errorf("chat: %s refused the login: %s %s", p.name, e, query.Get("error_description"))
+	}
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {ls.Verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.secret))
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("chat: token request to %s: %s", p.name, err)
+	}
+	claims, err := p.verify(token.IDToken, ls.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcUser{issuer: p.issuer, claims: claims}, nil
+}
+
+// verify checks the signature and the claims of an ID token.
+func (p *oidcProvider) verify(raw, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrIDToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %s", ErrIDToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %s", ErrIDToken, err)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	// alg 는 키 종류와 맞아야 한다. ("none" 이나 HS256 은 받지 않는다)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("%w: bad %s signature", ErrIDToken, header.Alg)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("%w: bad %s signature", ErrIDToken, header.Alg)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported key", ErrIDToken)
+	}
+
+	claims := new(oidcClaims)
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %s", ErrIDToken, err)
+	}
+	now := p.now()
+	exp, _ := claims.Expires.Int64()
+	iat, _ := claims.IssuedAt.Int64()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrIDToken, claims.Issuer)
+	case !claims.Audience.contains(p.clientID):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrIDToken)
+	case len(claims.Audience) > 1 && claims.AZP != p.clientID:
+		return nil, fmt.Errorf("%w: authorized party %q", ErrIDToken, claims.AZP)
+	case exp == 0 || now.After(time.Unix(exp, 0).Add(oidcClockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrIDToken)
+	case iat != 0 && time.Unix(iat, 0).After(now.Add(oidcClockSkew)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrIDToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrIDToken)
+	}
+	return claims, nil
+}
+
+// key returns the issuer's signing key kid, fetching the key set again
+// when kid is unknown, e.g. after the issuer rotated its keys.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("chat: keys of %s: %s", p.name, err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if k, err := jwk.publicKey(); err == nil && (jwk.Use == "" || jwk.Use == "sig") {
+			keys[jwk.Kid] = k
+		}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrIDToken, kid)
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return p.doJSON(req, v)
+}
+
+func (p *oidcProvider) doJSON(req *http.Request, v interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// jsonWebKey is a public key of a JWKS document.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// randomToken returns a random URL safe string for states, nonces and
+// PKCE verifiers.
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(randomSecret(32))
+}
+
+// oidcUser is the ChatUser of an OpenID Connect login.
+type oidcUser struct {
+	issuer string
+	claims *oidcClaims
+}
+
+// UniqueID is derived from the issuer and subject, which are stable and
+// unique, unlike the email an issuer may not have verified.
+func (u *oidcUser) UniqueID() string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(u.issuer+"#"+u.claims.Subject)))
+}
+
+// AvatarURL is the picture claim.
+func (u *oidcUser) AvatarURL() string {
+	return u.claims.Picture
+}
+
+// Name is the name claim, or the email or subject if there is none.
+func (u *oidcUser) Name() string {
+	switch {
+	case u.claims.Name != "":
+		return u.claims.Name
+	case u.claims.Email != "":
+		return u.claims.Email
+	}
+	return u.claims.Subject
+}
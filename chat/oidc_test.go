@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect issuer. Its authorize step is
+// done by the test calling authorize directly instead of a browser.
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	claims map[string]interface{} // extra claims or overrides for the next token
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorize request
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, kid: "k1", codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "secret" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		m.mu.Lock()
+		auth, ok := m.codes[r.PostFormValue("code")]
+		delete(m.codes, r.PostFormValue("code"))
+		m.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || auth.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) ||
+			auth.Get("redirect_uri") != r.PostFormValue("redirect_uri") {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":     m.URL,
+			"sub":     "user-1",
+			"aud":     "client",
+			"exp":     time.Now().Add(time.Hour).Unix(),
+			"iat":     time.Now().Unix(),
+			"nonce":   auth.Get("nonce"),
+			"name":    "Alice",
+			"picture": "https://example.com/alice.png",
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "x", "id_token": m.sign(claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockIssuer) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": m.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize plays the user logging in at loginURL and returns the
+// callback query the issuer would redirect to.
+func (m *mockIssuer) authorize(t *testing.T, loginURL string) url.Values {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" || !strings.Contains(q.Get("scope"), "openid") {
+		t.Fatalf("login URL is missing PKCE, nonce or scope: %s", loginURL)
+	}
+	code := randomToken()
+	m.mu.Lock()
+	m.codes[code] = q
+	m.mu.Unlock()
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+func TestOIDCProvider(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+	p := newOIDCProvider("mock", issuer.URL, "client", "secret", "http://localhost:8080/auth/callback/mock")
+
+	begin := func() (string, *loginState) {
+		ls := &loginState{Provider: "mock", Nonce: randomToken(), Verifier: randomToken()}
+		loginURL, err := p.BeginAuth(randomToken(), ls)
+		if err != nil {
+			t.Fatalf("BeginAuth should not return an error: %s", err)
+		}
+		return loginURL, ls
+	}
+
+	loginURL, ls := begin()
+	if !strings.HasPrefix(loginURL, issuer.URL+"/authorize?") {
+		t.Errorf("BeginAuth wrongly returned %s", loginURL)
+	}
+	callback := issuer.authorize(t, loginURL)
+	user, err := p.CompleteAuth(callback, ls)
+	if err != nil {
+		t.Fatalf("CompleteAuth should not return an error: %s", err)
+	}
+	if user.Name() != "Alice" || user.AvatarURL() != "https://example.com/alice.png" || user.UniqueID() == "" {
+		t.Errorf("CompleteAuth wrongly returned %+v", user.claims)
+	}
+	// the code can only be redeemed once
+	if _, err := p.CompleteAuth(callback, ls); err == nil {
+		t.Error("CompleteAuth should refuse a used code")
+	}
+	// PKCE: the verifier of another login does not match the challenge
+	loginURL, _ = begin()
+	_, other := begin()
+	if _, err := p.CompleteAuth(issuer.authorize(t, loginURL), other); err == nil {
+		t.Error("CompleteAuth should refuse a code without its verifier")
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"nonce":    {"nonce": "replayed"},
+		"audience": {"aud": "someone-else"},
+		"azp":      {"aud": []string{"client", "other"}, "azp": "other"},
+		"expired":  {"exp": time.Now().Add(-time.Hour).Unix()},
+		"issuer":   {"iss": "https://evil.example.com"},
+	} {
+		issuer.claims = claims
+		loginURL, ls := begin()
+		if _, err := p.CompleteAuth(issuer.authorize(t, loginURL), ls); !errors.Is(err, ErrIDToken) {
+			t.Errorf("%s: CompleteAuth should refuse the ID token, got %v", name, err)
+		}
+	}
+	issuer.claims = nil
+}
+
+func TestOIDCVerifySignature(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+	p := newOIDCProvider("mock", issuer.URL, "client", "secret", "http://localhost/cb")
+	claims := map[string]interface{}{
+		"iss": issuer.URL, "sub": "user-1", "aud": "client", "nonce": "n",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	if _, err := p.verify(issuer.sign(claims), "n"); err != nil {
+		t.Fatalf("verify should accept a good token: %s", err)
+	}
+
+	good := issuer.key
+	issuer.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	forged := issuer.sign(claims)
+	issuer.key = good
+	if _, err := p.verify(forged, "n"); !errors.Is(err, ErrIDToken) {
+		t.Errorf("verify should refuse a token signed by another key, got %v", err)
+	}
+
+	parts := strings.Split(issuer.sign(claims), ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+	if _, err := p.verify(none+"."+parts[1]+"."+parts[2], "n"); !errors.Is(err, ErrIDToken) {
+		t.Errorf("verify should refuse alg none, got %v", err)
+	}
+	if _, err := p.verify("not-a-token", "n"); !errors.Is(err, ErrIDToken) {
+		t.Errorf("verify should refuse a malformed token, got %v", err)
+	}
+}
+
+func TestOIDCLoginHandler(t *testing.T) {
+	newTestSession(t, "setup") // tokens and sessions
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+	p := newOIDCProvider("mock", issuer.URL, "client", "secret", "http://localhost/auth/callback/mock")
+	oidcProviders["mock"] = p
+	defer delete(oidcProviders, "mock")
+
+	w := httptest.NewRecorder()
+	loginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/login/mock?next=%2Fchat%3Froom%3Ddev", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("login wrongly returned %d: %s", w.Code, w.Body.String())
+	}
+	callback := issuer.authorize(t, w.Header().Get("Location"))
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback/mock?"+callback.Encode(), nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	loginHandler(w, req)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/chat?room=dev" {
+		t.Fatalf("callback wrongly returned %d to %s: %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, "/chat", nil)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == authCookieName {
+			req.AddCookie(cookie)
+		}
+	}
+	if sess, err := currentSession(req); err != nil || sess.Data["name"] != "Alice" {
+		t.Errorf("callback should start a session, got %v, %v", sess, err)
+	}
+
+	// without the state cookie (login CSRF)
+	w = httptest.NewRecorder()
+	loginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/login/mock", nil))
+	callback = issuer.authorize(t, w.Header().Get("Location"))
+	w = httptest.NewRecorder()
+	loginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/callback/mock?"+callback.Encode(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("callback without the state cookie should be refused, got %d", w.Code)
+	}
+}
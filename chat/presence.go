@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// idleAfter is how long a member can stay quiet before being marked idle.
+const idleAfter = 5 * time.Minute
+
+// member is a user present in a room. A user with several sockets
+// (e.g. two tabs) is a single member.
+type member struct {
+	UserID     string    `json:"userid"`
+	Name       string    `json:"name"`
+	AvatarURL  string    `json:"avatar_url"`
+	LastActive time.Time `json:"last_active"`
+	Idle       bool      `json:"idle"`
+
+	sockets int
+}
+
+// presence tracks the members of a room. It is only used from room.run.
+type presence struct {
+	members map[string]*member
+}
+
+func newPresence() *presence {
+	return &presence{members: make(map[string]*member)}
+}
+
+// join records a new socket of the user and returns the member if
+// the user was not in the room before.
+func (p *presence) join(c *client, now time.Time) *member {
+	id := c.userID()
+	if m, ok := p.members[id]; ok {
+		m.sockets++
+		m.LastActive = now
+		return nil
+	}
+	m := &member{UserID: id, LastActive: now, sockets: 1}
+	m.Name, _ = c.userData["name"].(string)
+	m.AvatarURL, _ = c.userData["avatar_url"].(string)
+	p.members[id] = m
+	return m
+}
+
+// leave removes a socket of the user and returns the member if it
+// was the user's last one.
+func (p *presence) leave(c *client) *member {
+	m, ok := p.members[c.userID()]
+	if !ok {
+		return nil
+	}
+	m.sockets--
+	if m.sockets > 0 {
+		return nil
+	}
+	delete(p.members, m.UserID)
+	return m
+}
+
+// active records activity of the user and returns the member if it
+// was idle until now.
+func (p *presence) active(userID string, now time.Time) *member {
+	m, ok := p.members[userID]
+	if !ok {
+		return nil
+	}
+	m.LastActive = now
+	if !m.Idle {
+		return nil
+	}
+	m.Idle = false
+	return m
+}
+
+// idle marks members that have been quiet for idleAfter and returns them.
+func (p *presence) idle(now time.Time) []*member {
+	var idle []*member
+	for _, m := range p.members {
+		if !m.Idle && now.Sub(m.LastActive) >= idleAfter {
+			m.Idle = true
+			idle = append(idle, m)
+		}
+	}
+	return idle
+}
+
+// roster returns a copy of the members sorted by name.
+func (p *presence) roster() []member {
+	members := make([]member, 0, len(p.members))
+	for _, m := range p.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// presenceMessage makes a join, leave, idle or active event about m.
+func presenceMessage(typ string, m *member, text string) *message {
+	return &message{
+		V:         protocolVersion,
+		Type:      typ,
+		Name:      m.Name,
+		Message:   m.Name + " " + text,
+		When:      time.Now(),
+		AvatarURL: m.AvatarURL,
+		UserID:    m.UserID,
+	}
+}
+
+// membersHandler serves the members of a room.
+// format: /rooms/{name}/members
+type membersHandler struct {
+	registry *roomRegistry
+}
+
+func (h *membersHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segs := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(segs) != 3 || segs[0] != "rooms" || segs[2] != "members" || !validRoomName(segs[1]) {
+		http.NotFound(w, req)
+		return
+	}
+	members := h.registry.members(segs[1])
+	if members == nil {
+		members = []member{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jihuichoi/GPB/trace"
+)
+
+// defaultRoomName is the room used when no name is given,
+// e.g. for the old /room endpoint.
+const defaultRoomName = "general"
+
+var roomNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// validRoomName reports whether name can be used as a room name.
+func validRoomName(name string) bool {
+	return roomNamePattern.MatchString(name)
+}
+
+// roomRegistry creates, looks up and tears down rooms by name.
+// A room's run loop is started when the first client joins and
+// stopped once the last client leaves.
+type roomRegistry struct {
+	mu    sync.Mutex
+	rooms map[string]*room
+	// refs counts the clients currently using each room.
+	refs map[*room]int
+
+	// tracer is handed to every room the registry creates.
+	tracer trace.Tracer
+
+	// store keeps the history of all rooms.
+	store MessageStore
+
+	// opts are the websocket keepalive settings of all rooms.
+	opts socketOptions
+
+	// editWindow is how long authors can change their messages.
+	editWindow time.Duration
+
+	// policy is the slow consumer policy of rooms not listed in policies.
+	policy   slowPolicy
+	policies map[string]slowPolicy
+
+	// broker connects the rooms to the same rooms on other nodes.
+	// node is the name of this server.
+	broker Broker
+	node   string
+
+	// closing is set once Shutdown started; no new clients are accepted.
+	closing bool
+	// active counts the clients between acquire and release.
+	active sync.WaitGroup
+}
+
+func newRoomRegistry() *roomRegistry {
+	return &roomRegistry{
+		rooms:      make(map[string]*room),
+		refs:       make(map[*room]int),
+		tracer:     trace.Off(),
+		store:      NewRingBufferStore(historySize),
+		opts:       defaultSocketOptions,
+		editWindow: defaultEditWindow,
+		policies:   make(map[string]slowPolicy),
+		node:       newMessageID()[:8],
+	}
+}
+
+// acquire returns the room with the given name, creating and
+// starting it if needed. Every call must be paired with release.
+// It returns nil once the registry is shutting down.
+func (reg *roomRegistry) acquire(name string) *room {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.closing {
+		return nil
+	}
+	r, ok := reg.rooms[name]
+	if !ok {
+		r = newRoom()
+		r.name = name
+		r.tracer = reg.tracer
+		r.store = reg.store
+		r.opts = reg.opts
+		r.editWindow = reg.editWindow
+		r.broker = reg.broker
+		r.node = reg.node
+		r.policy = reg.policy
+		if p, ok := reg.policies[name]; ok {
+			r.policy = p
+		}
+		reg.rooms[name] = r
+		go r.run()
+		reg.tracer.Trace("Room opened: ", name)
+	}
+	reg.refs[r]++
+	reg.active.Add(1)
+	return r
+}
+
+// release gives up a reference taken by acquire and stops the
+// room when nobody is using it anymore.
+func (reg *roomRegistry) release(r *room) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	defer reg.active.Done()
+	reg.refs[r]--
+	if reg.refs[r] > 0 {
+		return
+	}
+	delete(reg.refs, r)
+	delete(reg.rooms, r.name)
+	close(r.quit)
+	reg.tracer.Trace("Room closed: ", r.name)
+}
+
+// disconnect closes the websockets of every client, in every room,
+// for which match returns true.
+func (reg *roomRegistry) disconnect(match func(*client) bool) {
+	// 룸이 바쁘거나 release 를 기다리는 동안 registry 를 잠그지 않도록
+	// 목록만 복사하고 잠금을 푼 뒤에 보낸다.
+	reg.mu.Lock()
+	rooms := make([]*room, 0, len(reg.rooms))
+	for _, r := range reg.rooms {
+		rooms = append(rooms, r)
+	}
+	reg.mu.Unlock()
+	for _, r := range rooms {
+		select {
+		case r.evict <- match:
+		case <-r.quit: // 그 사이 마지막 클라이언트가 떠났다.
+		}
+	}
+}
+
+// Shutdown stops accepting clients, sends notice to every room, lets the
+// clients receive what is queued for them and waits until they are all
+// gone. It returns ctx.Err() if some are still connected when ctx is done.
+func (reg *roomRegistry) Shutdown(ctx context.Context, notice string) error {
+	reg.mu.Lock()
+	reg.closing = true
+	rooms := make([]*room, 0, len(reg.rooms))
+	for _, r := range reg.rooms {
+		rooms = append(rooms, r)
+	}
+	reg.mu.Unlock()
+
+	msg := systemMessage(notice)
+	for _, r := range rooms {
+		select {
+		case r.shutdown <- msg:
+		case <-r.quit: // 그 사이 마지막 클라이언트가 떠났다.
+		case <-ctx.Done():
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		reg.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// members returns the members of the named room, or nil if the
+// room is not active.
+func (reg *roomRegistry) members(name string) []member {
+	reg.mu.Lock()
+	r, ok := reg.rooms[name]
+	reg.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	reply := make(chan []member, 1)
+	select {
+	case r.roster <- reply:
+		return <-reply
+	case <-r.quit:
+		return nil
+	}
+}
+
+// roomInfo describes an active room in the /rooms listing.
+type roomInfo struct {
+	Name    string      `json:"name"`
+	Members int         `json:"members"`
+	Stats   fanoutStats `json:"stats"`
+}
+
+// list returns the active rooms sorted by name.
+func (reg *roomRegistry) list() []roomInfo {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	infos := make([]roomInfo, 0, len(reg.rooms))
+	for name, r := range reg.rooms {
+		infos = append(infos, roomInfo{Name: name, Members: reg.refs[r], Stats: r.stats.snapshot()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// ServeHTTP upgrades /room and /room/{name} to a websocket in the named room.
+func (reg *roomRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/room"), "/")
+	if name == "" {
+		name = defaultRoomName
+	}
+	if !validRoomName(name) {
+		http.NotFound(w, req)
+		return
+	}
+	r := reg.acquire(name)
+	if r == nil {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer reg.release(r)
+	r.ServeHTTP(w, req)
+}
+
+// roomsHandler serves the JSON listing of active rooms.
+type roomsHandler struct {
+	registry *roomRegistry
+}
+
+func (h *roomsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.registry.list())
+}
+
+// roomHandler serves the resources of a room.
+// format: /rooms/{name}/members or /rooms/{name}/threads/{id}
+type roomHandler struct {
+	registry *roomRegistry
+}
+
+func (h *roomHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segs := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(segs) < 3 || segs[0] != "rooms" || !validRoomName(segs[1]) {
+		http.NotFound(w, req)
+		return
+	}
+	// 차단된 사용자는 멤버 목록과 스레드도 볼 수 없다.
+	if refuseBanned(w, req, segs[1]) {
+		return
+	}
+	switch {
+	case len(segs) == 3 && segs[2] == "members":
+		(&membersHandler{registry: h.registry}).ServeHTTP(w, req)
+	case len(segs) == 4 && segs[2] == "threads":
+		serveThread(w, req, h.registry.store, segs[1], segs[3])
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jihuichoi/GPB/trace"
-	"github.com/stretchr/objx"
 )
 
 type room struct {
+	// name is the name the room is registered under.
+	name string
+
 	// forward is a channel that holds incoming messages
 	// that should be forwarded to the other clients.
 	// forward chan []byte
@@ -27,32 +31,344 @@ type room struct {
 	// test 를 위한 tracer
 	tracer trace.Tracer
 
-	// avatar is how avatar information will be obtained.
-	avatar Avatar
+	// store keeps the history of the room.
+	store MessageStore
+
+	// policy is what to do with clients that cannot keep up.
+	policy slowPolicy
+
+	// stats counts delivered and dropped messages.
+	stats fanoutStats
+
+	// opts are handed to every client that joins.
+	opts socketOptions
+
+	// editWindow is how long authors can change their messages.
+	editWindow time.Duration
+
+	// evict is a channel of filters; matching clients are disconnected.
+	evict chan func(*client) bool
+
+	// presence tracks the users in the room.
+	presence *presence
+
+	// roster receives requests for the current members.
+	roster chan chan []member
+
+	// broker carries messages to and from the same room on other
+	// nodes; node is the name of this server. broker may be nil.
+	broker Broker
+	node   string
+	// seen holds the IDs of recent messages to drop duplicates.
+	seen *seenIDs
+	// pending are the messages for the history this room published and
+	// waits to get back numbered from the broker, by ID.
+	pending map[string]pendingMessage
+	// lastSeq is the last sequence number stored for the room.
+	lastSeq int64
+
+	// shutdown receives a notice to send to every client before
+	// they are all disconnected because the server is going down.
+	shutdown chan *message
+
+	// quit is closed by the registry to stop the run loop.
+	quit chan struct{}
 }
 
 func (r *room) run() {
+	idleCheck := time.NewTicker(idleAfter / 5)
+	defer idleCheck.Stop()
+	// 룸이 닫혔다 다시 열려도 다시 보낸 메세지를 알아보도록 최근 ID 를 기억해둔다.
+	if msgs, err := lastMessages(r.store, r.name, historySize); err == nil {
+		for _, msg := range msgs {
+			r.seen.add(msg.ID)
+		}
+	}
+	r.lastSeq, _ = r.store.LastSeq(r.name)
+	// 다른 서버에서 같은 룸으로 들어온 메세지
+	var incoming <-chan *message
+	if r.broker != nil {
+		var cancel func()
+		incoming, cancel = r.broker.Subscribe(r.name)
+		defer cancel()
+	}
 	for { // 무한 루프 돌면서 아래 select 문을 반복
 		select {
 		case client := <-r.join: // join 채널에 클라이언트가 들어오면
 			// joining
 			r.clients[client] = true
+			users.add(client)
 			r.tracer.Trace("New Client joined")
+			if client.since > 0 {
+				r.resume(client)
+			} else {
+				r.replay(client)
+			}
+			// 같은 사용자가 탭을 여러개 열어도 처음 한번만 알린다.
+			if m := r.presence.join(client, time.Now()); m != nil {
+				r.broadcast(presenceMessage(typeJoin, m, "joined"), m.UserID)
+			}
 		case client := <-r.leave: // leave 채널에 클라이언트가 들어오면
 			// leaving
-			delete(r.clients, client)
-			close(client.send)
+			// shutdown 에서 이미 내보낸 클라이언트는 send 채널이 닫혀 있다.
+			if _, ok := r.clients[client]; ok {
+				delete(r.clients, client)
+				users.remove(client)
+				close(client.send)
+				if m := r.presence.leave(client); m != nil {
+					r.broadcast(presenceMessage(typeLeave, m, "left"), m.UserID)
+				}
+			}
 			r.tracer.Trace("Client left")
 		case msg := <-r.forward: // forward 채널에 메세지가 들어오면
 			// r.tracer.Trace("Message received: ", string(msg))
 			r.tracer.Trace("Message received: ", msg.Message)
-			// forward message to all clients
+			if msg.to != nil {
+				r.deliver(msg.to, msg)
+				continue
+			}
+			// 읽기만 가능하거나 mute 된 사용자 (moderation.go)
+			if msg.from != nil {
+				if err := moderation.allow(r.name, msg.UserID); err != nil {
+					r.deliver(msg.from, errorMessage(msg.from, err))
+					continue
+				}
+			}
+			if msg.Type == typeModerate {
+				r.moderate(msg)
+				continue
+			}
+			// 수정, 삭제, 반응은 대상 메세지를 찾아 권한을 확인한다. (edit.go)
+			if msg.from != nil && (msg.Type == typeEdit || msg.Type == typeDelete || msg.Type == typeReaction) {
+				if err := r.checkChange(msg); err != nil {
+					if err != errNoChange {
+						r.deliver(msg.from, errorMessage(msg.from, err))
+					}
+					continue
+				}
+			}
+			// 같은 Key 로 다시 보낸 메세지는 이미 전달되었다. (client.read 의 keyedMessageID)
+			if msg.Key != "" && msg.isChat() && !r.seen.add(msg.ID) {
+				r.tracer.Trace("Duplicate message dropped: ", msg.ID)
+				continue
+			}
+			// 답글은 원래 메세지가 룸에 있어야 한다. (thread.go)
+			if msg.from != nil && msg.Parent != "" {
+				if err := r.attachReply(msg); err != nil {
+					r.deliver(msg.from, errorMessage(msg.from, err))
+					continue
+				}
+			}
+			if m := r.presence.active(msg.UserID, msg.When); m != nil {
+				r.broadcast(presenceMessage(typeActive, m, "is back"), m.UserID)
+			}
+			r.tag(msg)
+			if r.broker != nil && msg.inHistory() {
+				// 모든 서버가 같은 Seq 와 순서로 저장하도록 broker 가 번호를 매긴다.
+				// 번호가 매겨져 돌아오면 (incoming) 저장하고 알린다.
+				r.sequence(msg)
+				continue
+			}
+			r.publish(msg)
+			r.accept(msg)
+		case msg, ok := <-incoming:
+			if !ok {
+				incoming = nil
+				continue
+			}
+			// 자기가 보낸 메세지는 번호를 받으러 보낸 것만 받는다.
+			if msg.Origin == r.node {
+				if pending, ok := r.pending[msg.ID]; ok {
+					delete(r.pending, msg.ID)
+					pending.msg.Seq = msg.Seq
+					r.accept(pending.msg)
+				}
+				continue
+			}
+			// 이미 받은 메세지는 버린다.
+			if !r.seen.add(msg.ID) {
+				continue
+			}
+			r.tracer.Trace("Message received from ", msg.Origin, ": ", msg.Message)
+			if msg.Type == typeModerate {
+				// 다른 서버에서 이미 권한을 확인했다.
+				if err := moderation.change(r.name, msg); err != nil {
+					r.tracer.Trace("Failed to apply moderation: ", err)
+				}
+				r.enforce(msg)
+				continue
+			}
+			// 언급된 사용자는 broker 로 오지 않으므로 이 서버가 아는 사용자 중에서 다시 찾는다.
+			if msg.Type == typeChat {
+				msg.mentions = users.mentioned(msg.Rich, msg.UserID)
+			}
+			r.accept(msg)
+		case <-idleCheck.C:
+			for _, m := range r.presence.idle(time.Now()) {
+				r.broadcast(presenceMessage(typeIdle, m, "is idle"), m.UserID)
+			}
+			r.expirePending(time.Now())
+		case reply := <-r.roster:
+			reply <- r.presence.roster()
+		case match := <-r.evict:
 			for client := range r.clients {
-				client.send <- msg // 각 클라이언트의 send 채널로 메세지 전달
-				r.tracer.Trace(" -- sent to client")
+				if match(client) {
+					// 소켓을 닫으면 client.read() 가 끝나고 leave 로 정리된다.
+					r.clients[client] = false
+					go client.closeWith(websocket.ClosePolicyViolation, "session ended")
+					r.tracer.Trace("Client evicted")
+				}
 			}
+		case notice := <-r.shutdown:
+			// 남은 메세지와 notice 를 보낸 뒤 going away 코드로 소켓을 닫는다. (client.write)
+			for client := range r.clients {
+				r.deliver(client, notice)
+				client.closeCode = websocket.CloseGoingAway
+				client.closeReason = notice.Message
+				delete(r.clients, client)
+				users.remove(client)
+				close(client.send)
+			}
+			r.presence = newPresence()
+			r.tracer.Trace("Room shut down")
+		case <-r.quit: // 마지막 클라이언트가 떠나면 registry 가 quit 을 닫는다.
+			return
+		}
+	}
+}
+
+// tag marks a locally received message with this node and an ID.
+func (r *room) tag(msg *message) {
+	if msg.Origin == "" {
+		msg.Origin = r.node
+	}
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+	r.seen.add(msg.ID)
+}
+
+// accept stores a message in the history if it belongs there and sends
+// it to the clients of the room and the users it mentions.
+func (r *room) accept(msg *message) {
+	// typing 같은 이벤트는 기록하지 않는다.
+	if msg.inHistory() {
+		if err := r.store.Append(r.name, msg); err != nil {
+			r.tracer.Trace("Failed to store message: ", err)
+		}
+		if msg.Seq > r.lastSeq {
+			r.lastSeq = msg.Seq
 		}
 	}
+	// forward message to all clients
+	r.broadcast(msg, "")
+	// 답글이 달리거나 지워지면 스레드 요약을 다시 알린다.
+	if msg.Parent != "" && msg.inHistory() {
+		r.announceThread(msg.Parent)
+	}
+	if len(msg.mentions) > 0 {
+		r.notifyMentions(msg)
+	}
+}
+
+// sequence publishes a tagged message for the history and keeps it
+// until the broker sends it back numbered. If the broker cannot take
+// it, the sender is told so and may send it again.
+func (r *room) sequence(msg *message) {
+	msg.Seq = r.lastSeq
+	err := r.broker.Publish(r.name, msg)
+	msg.Seq = 0
+	if err != nil {
+		r.tracer.Trace("Failed to publish message: ", err)
+		r.seen.remove(msg.ID)
+		r.deliver(msg.from, errorMessage(msg.from, ErrNotDelivered))
+		return
+	}
+	r.pending[msg.ID] = pendingMessage{msg: msg, since: time.Now()}
+}
+
+// pendingMessage is a message waiting to come back from the broker.
+type pendingMessage struct {
+	msg   *message
+	since time.Time
+}
+
+// expirePending gives up on the messages the broker did not send back
+// in time, e.g. because the connection to it dropped.
+func (r *room) expirePending(now time.Time) {
+	for id, pending := range r.pending {
+		if now.Sub(pending.since) < pendingTimeout {
+			continue
+		}
+		delete(r.pending, id)
+		r.seen.remove(id)
+		r.deliver(pending.msg.from, errorMessage(pending.msg.from, ErrNotDelivered))
+	}
+}
+
+// publish tags a locally received message, if it is not yet, and hands
+// it to the broker.
+func (r *room) publish(msg *message) {
+	r.tag(msg)
+	if r.broker == nil {
+		return
+	}
+	if err := r.broker.Publish(r.name, msg); err != nil {
+		r.tracer.Trace("Failed to publish message: ", err)
+	}
+}
+
+// send hands msg to the room from outside its run loop. It does not
+// block if the room has already stopped.
+func (r *room) send(msg *message) {
+	select {
+	case r.forward <- msg:
+	case <-r.quit:
+	}
+}
+
+// broadcast sends msg to every client except those of the user except.
+func (r *room) broadcast(msg *message, except string) {
+	for client := range r.clients {
+		if except != "" && client.userID() == except {
+			continue
+		}
+		// client.send <- msg // 각 클라이언트의 send 채널로 메세지 전달
+		// 한 클라이언트의 버퍼가 꽉 차면 룸 전체가 멈추므로 막히지 않게 보낸다. (fanout.go)
+		r.deliver(client, msg)
+		r.tracer.Trace(" -- sent to client")
+	}
+}
+
+// replay sends the latest messages of the room to a newly joined client.
+func (r *room) replay(c *client) {
+	msgs, err := lastMessages(r.store, r.name, replaySize)
+	if err != nil {
+		r.tracer.Trace("Failed to load history: ", err)
+		return
+	}
+	for _, msg := range msgs {
+		r.deliver(c, msg)
+	}
+}
+
+// resume sends a reconnected client what was stored after the last
+// message it got. If it missed too much, it gets the latest messages
+// as if it was new.
+func (r *room) resume(c *client) {
+	records, err := r.store.Since(r.name, c.since, resumeSize+1)
+	if err != nil {
+		r.tracer.Trace("Failed to load history: ", err)
+		return
+	}
+	if len(records) > resumeSize {
+		r.deliver(c, systemMessage("You missed too many messages; showing the latest ones"))
+		r.replay(c)
+		return
+	}
+	for _, record := range records {
+		r.deliver(c, record)
+	}
 }
 
 const (
@@ -64,15 +380,29 @@ const (
 var upgrader = &websocket.Upgrader{ReadBufferSize: socketBufferSize, WriteBufferSize: socketBufferSize}
 
 func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	socket, err := upgrader.Upgrade(w, req, nil)
+	// ch2: auth
+	// 업그레이드 전에 쿠키를 검증한다. 검증에 실패하면 소켓을 열지 않는다.
+	sess, err := currentSession(req)
 	if err != nil {
-		log.Fatal("ServeHTTP:", err)
+		http.Error(w, "Failed to get auth cookie: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
-	// ch2: auth
-	authCookie, err := req.Cookie("auth")
+	// 차단된 사용자는 소켓을 열기 전에 돌려보낸다.
+	if moderation.banned(r.name, sess.UserID) {
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return
+	}
+	// 다시 연결한 브라우저는 마지막으로 받은 메세지 번호를 since 로 보낸다.
+	var since int64
+	if s := req.URL.Query().Get("since"); s != "" {
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	socket, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
-		log.Fatal("Failed to get auth cookie:", err)
+		log.Println("ServeHTTP:", err)
 		return
 	}
 
@@ -80,9 +410,12 @@ func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	client := &client{
 		socket: socket,
 		// send:   make(chan []byte, messageBufferSize),
-		send:     make(chan *message, messageBufferSize),
-		room:     r,
-		userData: objx.MustFromBase64(authCookie.Value),
+		send:      make(chan *message, messageBufferSize),
+		room:      r,
+		userData:  sess.Data,
+		sessionID: sess.ID,
+		opts:      r.opts,
+		since:     since,
 	}
 	r.join <- client                     // room 입장을 위해 join 채널에 클라이언트를 전달
 	defer func() { r.leave <- client }() // 웹소켓 종료시 클라이언트가 룸에서 떠남을 기록
@@ -93,11 +426,20 @@ func (r *room) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func newRoom() *room {
 	return &room{
 		// forward: make(chan []byte),
-		forward: make(chan *message),
-		join:    make(chan *client),
-		leave:   make(chan *client),
-		clients: make(map[*client]bool),
-		tracer:  trace.Off(),
-		// avatar:  avatar,
+		forward:    make(chan *message),
+		join:       make(chan *client),
+		leave:      make(chan *client),
+		evict:      make(chan func(*client) bool),
+		shutdown:   make(chan *message),
+		presence:   newPresence(),
+		roster:     make(chan chan []member),
+		seen:       newSeenIDs(4096),
+		pending:    make(map[string]pendingMessage),
+		clients:    make(map[*client]bool),
+		tracer:     trace.Off(),
+		store:      NewRingBufferStore(historySize),
+		opts:       defaultSocketOptions,
+		editWindow: defaultEditWindow,
+		quit:       make(chan struct{}),
 	}
 }
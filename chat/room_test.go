@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSocket returns the server side of a real websocket connection.
+func newTestSocket(t *testing.T) *websocket.Conn {
+	sockets := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		socket, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		sockets <- socket
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return <-sockets
+}
+
+// waitForRoom returns once r has handled everything sent to it so far.
+func waitForRoom(r *room) []member {
+	reply := make(chan []member)
+	r.roster <- reply
+	return <-reply
+}
+
+var testClients int
+
+// newTestClient makes a client of a new user.
+func newTestClient(t *testing.T, r *room) *client {
+	testClients++
+	return newTestUserClient(t, r, fmt.Sprintf("user%d", testClients))
+}
+
+func newTestUserClient(t *testing.T, r *room, userID string) *client {
+	return &client{
+		socket:   newTestSocket(t),
+		send:     make(chan *message, messageBufferSize),
+		room:     r,
+		userData: map[string]interface{}{"userid": userID, "name": userID},
+	}
+}
+
+// receive reads messages from c until n have arrived or it times out.
+func receive(t *testing.T, c *client, n int) []*message {
+	var msgs []*message
+	timeout := time.After(2 * time.Second)
+	for len(msgs) < n {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				t.Errorf("send channel closed after %d messages", len(msgs))
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		case <-timeout:
+			t.Errorf("received only %d of %d messages", len(msgs), n)
+			return msgs
+		}
+	}
+	return msgs
+}
+
+func testSlowConsumer(t *testing.T, policy slowPolicy) (*room, *client) {
+	r := newRoom()
+	r.name = "test"
+	r.policy = policy
+	go r.run()
+	defer close(r.quit)
+
+	stuck := newTestClient(t, r) // nobody reads stuck.send
+	healthy := newTestClient(t, r)
+	r.join <- healthy
+	r.join <- stuck
+	receive(t, healthy, 1) // stuck joined
+
+	// the healthy client must keep receiving after the stuck one's buffer is full
+	total := messageBufferSize + 10
+	for i := 0; i < total; i++ {
+		r.forward <- &message{Message: "hello"}
+		if msgs := receive(t, healthy, 1); len(msgs) != 1 {
+			t.Fatalf("healthy client stopped receiving after %d messages", i)
+		}
+	}
+	return r, stuck
+}
+
+func TestRoomDropOldest(t *testing.T) {
+	r, stuck := testSlowConsumer(t, dropOldest)
+	if got := r.stats.snapshot().Dropped; got != 10 {
+		t.Errorf("room should have dropped 10 messages, got %d", got)
+	}
+	if len(stuck.send) != messageBufferSize {
+		t.Errorf("stuck client should still have a full buffer, got %d", len(stuck.send))
+	}
+}
+
+func TestRoomDropNewest(t *testing.T) {
+	r, stuck := testSlowConsumer(t, dropNewest)
+	if got := r.stats.snapshot().Dropped; got != 10 {
+		t.Errorf("room should have dropped 10 messages, got %d", got)
+	}
+	if len(stuck.send) != messageBufferSize {
+		t.Errorf("stuck client should still have a full buffer, got %d", len(stuck.send))
+	}
+}
+
+func TestRoomDisconnectSlow(t *testing.T) {
+	r, stuck := testSlowConsumer(t, disconnectSlow)
+	if got := r.stats.snapshot().Disconnected; got != 1 {
+		t.Errorf("room should have disconnected 1 client, got %d", got)
+	}
+	if _, _, err := stuck.socket.ReadMessage(); err == nil {
+		t.Error("stuck client's socket should be closed")
+	}
+}
+
+func TestParseSlowPolicies(t *testing.T) {
+	def, rooms, err := parseSlowPolicies("drop-newest,lobby=disconnect")
+	if err != nil {
+		t.Fatalf("parseSlowPolicies should not return an error: %s", err)
+	}
+	if def != dropNewest || rooms["lobby"] != disconnectSlow {
+		t.Errorf("parseSlowPolicies wrongly returned %v, %v", def, rooms)
+	}
+	if _, _, err := parseSlowPolicies("drop-everything"); err == nil {
+		t.Error("parseSlowPolicies should return an error for an unknown policy")
+	}
+}
+
+func TestRoomShutdown(t *testing.T) {
+	r := newRoom()
+	go r.run()
+	defer close(r.quit)
+
+	c := newTestClient(t, r)
+	r.join <- c
+	r.forward <- &message{Message: "hello"}
+	r.shutdown <- &message{Name: "system", Message: "server restarting"}
+
+	msgs := receive(t, c, 2)
+	if msgs[0].Message != "hello" || msgs[1].Message != "server restarting" {
+		t.Errorf("client should receive pending messages then the notice, got %v", msgs)
+	}
+	if _, ok := <-c.send; ok {
+		t.Error("send channel should be closed after shutdown")
+	}
+	if c.closeCode != websocket.CloseGoingAway {
+		t.Errorf("client should be closed with going away, got %d", c.closeCode)
+	}
+	r.leave <- c // must not close send twice
+}
+
+func TestRegistryShutdown(t *testing.T) {
+	reg := newRoomRegistry()
+	r := reg.acquire("test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := reg.Shutdown(ctx, "bye"); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown should time out while a client is connected, got %v", err)
+	}
+	if reg.acquire("test") != nil {
+		t.Error("acquire should return nil while shutting down")
+	}
+
+	reg.release(r)
+	if err := reg.Shutdown(context.Background(), "bye"); err != nil {
+		t.Errorf("Shutdown should not return an error once all clients left, got %v", err)
+	}
+}
+
+func TestRegistryRooms(t *testing.T) {
+	reg := newRoomRegistry()
+	list := func() []roomInfo {
+		w := httptest.NewRecorder()
+		(&roomsHandler{registry: reg}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rooms", nil))
+		var infos []roomInfo
+		if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+	if infos := list(); infos == nil || len(infos) != 0 {
+		t.Errorf("no room should be listed before anyone joins, got %+v", infos)
+	}
+
+	// 룸은 처음 들어올 때 만들어지고 실행된다.
+	a := reg.acquire("lobby")
+	b := reg.acquire("lobby")
+	if a != b {
+		t.Fatal("acquire should return the running room of the same name")
+	}
+	waitForRoom(a) // run loop answers
+	reg.release(reg.acquire("kitchen"))
+	if infos := list(); len(infos) != 1 || infos[0].Name != "lobby" || infos[0].Members != 2 {
+		t.Errorf("listing should show lobby with 2 members, got %+v", infos)
+	}
+
+	// 마지막 클라이언트가 떠나면 멈춘다.
+	reg.release(a)
+	select {
+	case <-a.quit:
+		t.Fatal("room should run while a client is left")
+	default:
+	}
+	reg.release(b)
+	select {
+	case <-a.quit:
+	case <-time.After(time.Second):
+		t.Fatal("room should stop once the last client left")
+	}
+	if infos := list(); len(infos) != 0 {
+		t.Errorf("stopped rooms should not be listed, got %+v", infos)
+	}
+	c := reg.acquire("lobby")
+	defer reg.release(c)
+	if c == a {
+		t.Error("joining again should start a new room")
+	}
+}
+
+func TestRegistryDisconnect(t *testing.T) {
+	reg := newRoomRegistry()
+	// run 이 아직 evict 를 받지 않는 룸
+	stuck := newRoom()
+	stuck.name = "stuck"
+	reg.mu.Lock()
+	reg.rooms[stuck.name] = stuck
+	reg.refs[stuck] = 1
+	reg.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		reg.disconnect(func(c *client) bool { return c.sessionID == "revoked" })
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond) // disconnect 가 stuck 에 보내려고 기다리는 동안
+	acquired := make(chan *room)
+	go func() { acquired <- reg.acquire("lobby") }()
+	select {
+	case r := <-acquired:
+		reg.release(r)
+	case <-time.After(time.Second):
+		t.Fatal("disconnect should not hold the registry while it waits for a room")
+	}
+
+	// 그 사이 룸이 닫히면 disconnect 도 끝난다.
+	close(stuck.quit)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("disconnect should give up on a room that stopped")
+	}
+}
+
+func TestRoomPresence(t *testing.T) {
+	r := newRoom()
+	go r.run()
+	defer close(r.quit)
+
+	other := newTestUserClient(t, r, "other")
+	r.join <- other
+	tab1 := newTestUserClient(t, r, "abc")
+	tab2 := newTestUserClient(t, r, "abc")
+	r.join <- tab1
+	r.join <- tab2
+
+	if msgs := receive(t, other, 1); msgs[0].Type != typeJoin || msgs[0].UserID != "abc" {
+		t.Errorf("other member should be told abc joined, got %+v", msgs[0])
+	}
+	if members := waitForRoom(r); len(members) != 2 {
+		t.Errorf("room should have 2 members, got %+v", members)
+	}
+
+	r.leave <- tab1
+	r.leave <- tab2
+	if msgs := receive(t, other, 1); msgs[0].Type != typeLeave || msgs[0].UserID != "abc" {
+		t.Errorf("other member should be told abc left once, got %+v", msgs[0])
+	}
+	if len(other.send) != 0 {
+		t.Errorf("other member should get one join and one leave, got %d more", len(other.send))
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	lobby, kitchen := newRoom(), newRoom()
+	go lobby.run()
+	go kitchen.run()
+	defer close(lobby.quit)
+	defer close(kitchen.quit)
+
+	sender := newTestUserClient(t, lobby, "sender")
+	recipient := newTestUserClient(t, kitchen, "recipient")
+	bystander := newTestUserClient(t, lobby, "bystander")
+	lobby.join <- bystander
+	lobby.join <- sender
+	kitchen.join <- recipient
+	receive(t, bystander, 1) // sender joined
+	waitForRoom(kitchen)
+	defer func() {
+		lobby.leave <- sender
+		lobby.leave <- bystander
+		kitchen.leave <- recipient
+	}()
+
+	sender.sendDirect(&message{Type: typeDirect, UserID: "sender", To: "recipient", Message: "psst"})
+	if msgs := receive(t, recipient, 1); msgs[0].Message != "psst" {
+		t.Errorf("recipient should get the direct message in another room, got %+v", msgs[0])
+	}
+	if msgs := receive(t, sender, 1); msgs[0].Message != "psst" {
+		t.Errorf("sender should get a copy of the direct message, got %+v", msgs[0])
+	}
+	if len(bystander.send) != 0 {
+		t.Error("direct message should not be broadcast to the room")
+	}
+	if msgs, _ := lastMessages(lobby.store, directKey("recipient", "sender"), 10); len(msgs) != 1 {
+		t.Errorf("direct message should be stored under the conversation, got %v", msgs)
+	}
+
+	sender.sendDirect(&message{Type: typeDirect, UserID: "sender", To: "nobody", Message: "hello?"})
+	if msgs := receive(t, sender, 1); msgs[0].Type != typeError {
+		t.Errorf("sender should get an error frame for an unknown user, got %+v", msgs[0])
+	}
+}
+
+func TestHistoryWith(t *testing.T) {
+	users.remember(map[string]interface{}{"userid": "bob", "name": "bob"})
+	store := NewRingBufferStore(10)
+	store.Append(directKey("alice", "bob"), &message{Type: typeDirect, Message: "psst"})
+	h := &historyHandler{store: store}
+	cookie := newTestSession(t, "mallory")
+
+	for with, code := range map[string]int{
+		"bob":                http.StatusOK,
+		"~~/../@alice%2Bbob": http.StatusBadRequest,
+		"nobody":             http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/history?with="+with, nil)
+		req.AddCookie(cookie)
+		h.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("with=%s should get %d, got %d", with, code, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "psst") {
+			t.Errorf("with=%s should not show alice and bob's messages", with)
+		}
+	}
+}
+
+func TestUserLookup(t *testing.T) {
+	// 재시작 전에 로그인한 사용자는 세션 저장소에만 있다.
+	newTestSession(t, "quinn")
+	if _, ok := users.lookup("quinn"); !ok {
+		t.Error("user with a session should be found after a restart")
+	}
+	if _, ok := users.lookup("nobody"); ok {
+		t.Error("user without a session should not be found")
+	}
+
+	filename := filepath.Join(t.TempDir(), "users.json")
+	idx, err := openUserIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.remember(map[string]interface{}{"userid": "rita", "name": "Rita"})
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err = openUserIndex(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if info, ok := idx.lookup("rita"); !ok || info.Name != "Rita" {
+		t.Errorf("reopened index should know rita, got %+v", info)
+	}
+
+	// 다른 서버에 로그인한 사용자
+	broker := NewInProcessBroker()
+	here, there := newUserIndex(), newUserIndex()
+	defer here.share(broker, "here")()
+	defer there.share(broker, "there")()
+	there.login(map[string]interface{}{"userid": "sven", "name": "Sven"})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if info, ok := here.lookup("sven"); ok {
+			if info.Name != "Sven" {
+				t.Errorf("announced user should keep their name, got %+v", info)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("user who logged in on another server should be found")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRoomResume(t *testing.T) {
+	r := newRoom()
+	r.name = "test"
+	go r.run()
+	defer close(r.quit)
+
+	for _, text := range []string{"one", "two", "three"} {
+		r.forward <- &message{Type: typeChat, ID: newMessageID(), Message: text}
+	}
+	waitForRoom(r)
+
+	// 두번째 메세지까지 받고 끊겼던 브라우저
+	back := newTestClient(t, r)
+	back.since = 2
+	r.join <- back
+	waitForRoom(r)
+	if len(back.send) != 1 {
+		t.Fatalf("reconnected client should get only the missed message, got %d", len(back.send))
+	}
+	if msg := <-back.send; msg.Message != "three" || msg.Seq != 3 {
+		t.Errorf("reconnected client wrongly got %+v", msg)
+	}
+
+	fresh := newTestClient(t, r)
+	r.join <- fresh
+	waitForRoom(r)
+	if len(fresh.send) != 3 {
+		t.Errorf("new client should get the latest messages, got %d", len(fresh.send))
+	}
+}
+
+func TestRoomIdempotencyKey(t *testing.T) {
+	store := NewRingBufferStore(historySize)
+	r := newRoom()
+	r.name = "test"
+	r.store = store
+	go r.run()
+
+	sender := newTestUserClient(t, r, "sender")
+	bystander := newTestClient(t, r)
+	r.join <- bystander
+	r.join <- sender
+	receive(t, bystander, 1) // sender joined
+	send := func(key string) {
+		r.forward <- &message{Type: typeChat, ID: keyedMessageID("sender", key), Key: key, UserID: "sender", Message: "hi", from: sender}
+	}
+	send("k1")
+	send("k1")
+	send("k2")
+	if msgs := receive(t, bystander, 2); msgs[1].Key != "k2" {
+		t.Errorf("message sent again should be dropped, got %+v", msgs[1])
+	}
+	if keyedMessageID("sender", "k1") == keyedMessageID("other", "k1") {
+		t.Error("keys of different users should not collide")
+	}
+	close(r.quit)
+
+	// 룸이 닫혔다 다시 열려도 기록에 있는 메세지는 다시 올라가지 않는다.
+	r = newRoom()
+	r.name = "test"
+	r.store = store
+	go r.run()
+	defer close(r.quit)
+	send("k1")
+	waitForRoom(r)
+	if msgs, _ := lastMessages(store, "test", 10); len(msgs) != 2 {
+		t.Errorf("history should have 2 messages, got %d", len(msgs))
+	}
+}
+
+func TestClientStamp(t *testing.T) {
+	c := newTestUserClient(t, newRoom(), "alice")
+	ids := make(map[string]bool)
+	for _, typ := range []string{typeChat, typeDirect, typeTyping, typeEdit, typeDelete, typeReaction, typeModerate, typeIdle, typeActive} {
+		msg := &message{Type: typ, ID: "forged", Origin: "elsewhere", Seq: 42, Room: "other"}
+		c.stamp(msg)
+		if msg.ID == "" || msg.ID == "forged" || ids[msg.ID] {
+			t.Errorf("%s frame should get a new ID from the server, got %q", typ, msg.ID)
+		}
+		ids[msg.ID] = true
+		if msg.UserID != "alice" || msg.Origin != "" || msg.Seq != 0 || msg.Room != "" {
+			t.Errorf("%s frame should only carry server values, got %+v", typ, msg)
+		}
+	}
+	msg := &message{Type: typeChat, ID: "forged", Key: "k1"}
+	c.stamp(msg)
+	if msg.ID != keyedMessageID("alice", "k1") {
+		t.Errorf("a chat message with a key should get the keyed ID, got %q", msg.ID)
+	}
+	msg = &message{Type: typeReaction, Key: "k1"}
+	c.stamp(msg)
+	if msg.ID == keyedMessageID("alice", "k1") {
+		t.Error("only chat and direct messages use keyed IDs")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// saver runs save in the background some time after it is told that
+// something changed, so a burst of changes is saved at once and callers
+// such as room.run never wait for the disk. A nil saver saves nothing,
+// for stores kept in memory only.
+type saver struct {
+	delay time.Duration
+	save  func() error
+	// changed wakes up the saver, done stops it and saved is closed
+	// once it has stopped.
+	changed chan struct{}
+	done    chan struct{}
+	saved   chan struct{}
+}
+
+// newSaver starts calling save, delay after changes.
+func newSaver(delay time.Duration, save func() error) *saver {
+	s := &saver{
+		delay:   delay,
+		save:    save,
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		saved:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// newFileSaver starts saving data to filename, delay after changes.
+// data returns what to write, taking whatever locks it needs. The file
+// is written to a temporary file and renamed, so it is never left half
+// written.
+func newFileSaver(filename string, delay time.Duration, data func() ([]byte, error)) *saver {
+	return newSaver(delay, func() error {
+		b, err := data()
+		if err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+		tmp := filename + ".tmp"
+		if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, filename)
+	})
+}
+
+// touch tells the saver there is something to save. It does not wait;
+// a save already due includes the change.
+func (s *saver) touch() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops saving in the background and saves one last time.
+func (s *saver) Close() error {
+	if s == nil {
+		return nil
+	}
+	close(s.done)
+	<-s.saved
+	return s.save()
+}
+
+func (s *saver) run() {
+	defer close(s.saved)
+	for {
+		select {
+		case <-s.changed:
+			select {
+			case <-time.After(s.delay):
+			case <-s.done:
+				return
+			}
+			if err := s.save(); err != nil {
+				log.Println("Failed to save:", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+// ErrNoSession is returned when a session does not exist, has
+// expired or has been revoked.
+var ErrNoSession = errors.New("chat: no such session")
+
+// session is a server-side login session. The auth cookie only
+// carries its ID.
+type session struct {
+	ID        string                 `json:"id"`
+	UserID    string                 `json:"userid"`
+	Data      map[string]interface{} `json:"data"`
+	UserAgent string                 `json:"user_agent"`
+	Created   time.Time              `json:"created"`
+	LastSeen  time.Time              `json:"last_seen"`
+}
+
+// SessionStore keeps sessions by ID.
+type SessionStore interface {
+	Save(s *session) error
+	Get(id string) (*session, error)
+	Delete(id string) error
+	// ByUser returns all sessions of the user.
+	ByUser(userID string) ([]*session, error)
+}
+
+// MemorySessionStore keeps sessions in memory.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// NewMemorySessionStore makes an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*session)}
+}
+
+// Save is ...
+func (s *MemorySessionStore) Save(sess *session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *sess
+	s.sessions[sess.ID] = &copied
+	return nil
+}
+
+// Get is ...
+func (s *MemorySessionStore) Get(id string) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	copied := *sess
+	return &copied, nil
+}
+
+// Delete is ...
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// ByUser is ...
+func (s *MemorySessionStore) ByUser(userID string) ([]*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*session
+	for _, sess := range s.sessions {
+		if sess.UserID == userID {
+			copied := *sess
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result, nil
+}
+
+// FileSessionStore is a MemorySessionStore that writes every change
+// to a JSON file, so sessions survive a restart.
+type FileSessionStore struct {
+	*MemorySessionStore
+	filename string
+}
+
+// NewFileSessionStore loads the sessions saved in filename, if any.
+func NewFileSessionStore(filename string) (*FileSessionStore, error) {
+	s := &FileSessionStore{MemorySessionStore: NewMemorySessionStore(), filename: filename}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.sessions); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// flush writes all sessions to the file. s.mu must be held.
+func (s *FileSessionStore) flush() error {
+	data, err := json.Marshal(s.sessions)
+	if err != nil {
+		return err
+	}
+	// 임시 파일에 쓰고 rename 해서 중간에 죽어도 파일이 깨지지 않게 한다.
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+// Save is ...
+func (s *FileSessionStore) Save(sess *session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *sess
+	s.sessions[sess.ID] = &copied
+	return s.flush()
+}
+
+// Delete is ...
+func (s *FileSessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return s.flush()
+}
+
+// touchInterval limits how often LastSeen is written back to the store.
+const touchInterval = time.Minute
+
+// sessionManager creates sessions and enforces their timeouts.
+type sessionManager struct {
+	store SessionStore
+	// idleTimeout ends a session that has not been used for that long.
+	idleTimeout time.Duration
+	// absoluteTimeout ends a session that long after login regardless of use.
+	absoluteTimeout time.Duration
+	// onRevoke is called with the sessions that were revoked, so that
+	// their websockets can be disconnected.
+	onRevoke func(ids []string)
+	now      func() time.Time
+}
+
+// sessions is the session manager used by the handlers. It is set up in main.
+var sessions *sessionManager
+
+func newSessionManager(store SessionStore, idle, absolute time.Duration) *sessionManager {
+	return &sessionManager{
+		store:           store,
+		idleTimeout:     idle,
+		absoluteTimeout: absolute,
+		onRevoke:        func([]string) {},
+		now:             time.Now,
+	}
+}
+
+func newSessionID() string {
+	return base64.RawURLEncoding.EncodeToString(randomSecret(32))
+}
+
+// Create starts a new session for the user described by data.
+func (m *sessionManager) Create(data map[string]interface{}, userAgent string) (*session, error) {
+	now := m.now()
+	sess := &session{
+		ID:        newSessionID(),
+		UserID:    objx.New(data).Get("userid").Str(),
+		Data:      data,
+		UserAgent: userAgent,
+		Created:   now,
+		LastSeen:  now,
+	}
+	if err := m.store.Save(sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Lookup returns the live session with the given ID and records the use.
+func (m *sessionManager) Lookup(id string) (*session, error) {
+	sess, err := m.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	if now.Sub(sess.LastSeen) > m.idleTimeout || now.Sub(sess.Created) > m.absoluteTimeout {
+		m.store.Delete(id)
+		return nil, ErrNoSession
+	}
+	if now.Sub(sess.LastSeen) > touchInterval {
+		sess.LastSeen = now
+		if err := m.store.Save(sess); err != nil {
+			return nil, err
+		}
+	}
+	return sess, nil
+}
+
+// Sessions returns the live sessions of the user.
+func (m *sessionManager) Sessions(userID string) ([]*session, error) {
+	all, err := m.store.ByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	var live []*session
+	for _, sess := range all {
+		if _, err := m.Lookup(sess.ID); err == nil {
+			live = append(live, sess)
+		}
+	}
+	return live, nil
+}
+
+// Revoke ends the given sessions and disconnects their websockets.
+func (m *sessionManager) Revoke(ids ...string) error {
+	for _, id := range ids {
+		if err := m.store.Delete(id); err != nil {
+			return err
+		}
+	}
+	m.onRevoke(ids)
+	return nil
+}
+
+// RevokeUser ends every session of the user ("logout everywhere").
+func (m *sessionManager) RevokeUser(userID string) error {
+	all, err := m.store.ByUser(userID)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(all))
+	for i, sess := range all {
+		ids[i] = sess.ID
+	}
+	return m.Revoke(ids...)
+}
+
+// currentSession verifies the auth cookie of the request and returns
+// the session it refers to.
+func currentSession(r *http.Request) (*session, error) {
+	cookie, err := r.Cookie(authCookieName)
+	if err != nil {
+		return nil, err
+	}
+	if cookie.Value == "" {
+		return nil, http.ErrNoCookie
+	}
+	data, err := tokens.Decode(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	return sessions.Lookup(data.Get("sid").Str())
+}
+
+// sessionInfo describes a session in the /sessions listing.
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+// sessionsHandler lists the current user's sessions and revokes them.
+// format: GET /sessions, POST /sessions/revoke (id={session id} or all=true)
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	current, err := currentSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/sessions":
+		all, err := sessions.Sessions(current.UserID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		infos := make([]sessionInfo, len(all))
+		for i, sess := range all {
+			infos[i] = sessionInfo{
+				ID:        sess.ID,
+				UserAgent: sess.UserAgent,
+				Created:   sess.Created,
+				LastSeen:  sess.LastSeen,
+				Current:   sess.ID == current.ID,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	case "/sessions/revoke":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.FormValue("all") == "true" {
+			err = sessions.RevokeUser(current.UserID)
+		} else {
+			// 다른 사용자의 세션은 끊을 수 없다.
+			sess, lookupErr := sessions.store.Get(r.FormValue("id"))
+			if lookupErr != nil || sess.UserID != current.UserID {
+				http.Error(w, ErrNoSession.Error(), http.StatusNotFound)
+				return
+			}
+			err = sessions.Revoke(sess.ID)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
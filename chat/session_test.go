@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionManager(t *testing.T) {
+	now := time.Now()
+	m := newSessionManager(NewMemorySessionStore(), time.Hour, 24*time.Hour)
+	m.now = func() time.Time { return now }
+	var revoked []string
+	m.onRevoke = func(ids []string) { revoked = append(revoked, ids...) }
+
+	first, err := m.Create(map[string]interface{}{"userid": "abc"}, "browser")
+	if err != nil {
+		t.Fatalf("Create should not return an error: %s", err)
+	}
+	second, _ := m.Create(map[string]interface{}{"userid": "abc"}, "phone")
+
+	if sess, err := m.Lookup(first.ID); err != nil || sess.UserID != "abc" {
+		t.Errorf("Lookup wrongly returned %v, %v", sess, err)
+	}
+	if all, _ := m.Sessions("abc"); len(all) != 2 {
+		t.Errorf("Sessions should return 2 sessions, got %d", len(all))
+	}
+
+	// idle timeout
+	now = now.Add(2 * time.Hour)
+	if _, err := m.Lookup(first.ID); err != ErrNoSession {
+		t.Errorf("Lookup should return ErrNoSession for an idle session, got %v", err)
+	}
+
+	third, _ := m.Create(map[string]interface{}{"userid": "abc"}, "browser")
+	m.Create(map[string]interface{}{"userid": "def"}, "browser")
+	if err := m.RevokeUser("abc"); err != nil {
+		t.Fatalf("RevokeUser should not return an error: %s", err)
+	}
+	if _, err := m.Lookup(third.ID); err != ErrNoSession {
+		t.Errorf("Lookup should return ErrNoSession for a revoked session, got %v", err)
+	}
+	if len(revoked) != 2 || (revoked[0] != second.ID && revoked[1] != second.ID) {
+		t.Errorf("onRevoke wrongly called with %v", revoked)
+	}
+	if all, _ := m.Sessions("def"); len(all) != 1 {
+		t.Error("RevokeUser should not touch other users' sessions")
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "sessions.json")
+
+	store, err := NewFileSessionStore(filename)
+	if err != nil {
+		t.Fatalf("NewFileSessionStore should not return an error: %s", err)
+	}
+	store.Save(&session{ID: "1", UserID: "abc", Data: map[string]interface{}{"name": "Jihui"}})
+
+	store, err = NewFileSessionStore(filename)
+	if err != nil {
+		t.Fatalf("NewFileSessionStore should not return an error: %s", err)
+	}
+	sess, err := store.Get("1")
+	if err != nil || sess.Data["name"] != "Jihui" {
+		t.Errorf("FileSessionStore should load saved sessions, got %v, %v", sess, err)
+	}
+}
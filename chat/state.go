@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLoginState is returned when a login callback's state is unknown,
+// expired, used twice, or does not belong to the browser it came to.
+var ErrLoginState = errors.New("chat: invalid or expired login state")
+
+const (
+	// loginTimeout is how long a user has to finish logging in at the provider.
+	loginTimeout = 10 * time.Minute
+	// loginStateCookie ties a login in progress to the browser that started
+	// it, so nobody can make a victim's browser finish the attacker's login.
+	loginStateCookie = "login_state"
+	// defaultNext is where users go after login when nothing else was asked for.
+	defaultNext = "/chat"
+)
+
+// loginState is a login in progress, from /auth/login to /auth/callback.
+type loginState struct {
+	Provider string
+	// Next is where to send the user after logging in.
+	Next string
+	// Nonce and Verifier are used by OpenID Connect (oidc.go).
+	Nonce    string
+	Verifier string
+	expires  time.Time
+}
+
+// stateStore keeps the logins in progress by their state value.
+type stateStore struct {
+	mu     sync.Mutex
+	states map[string]*loginState
+	now    func() time.Time
+}
+
+// loginStates are the logins in progress of all providers.
+var loginStates = newStateStore()
+
+func newStateStore() *stateStore {
+	return &stateStore{states: make(map[string]*loginState), now: time.Now}
+}
+
+// begin starts a login with provider, remembers it in the browser and
+// returns its state value to send to the provider.
+func (s *stateStore) begin(w http.ResponseWriter, provider, next string) (string, *loginState) {
+	id := randomToken()
+	ls := &loginState{
+		Provider: provider,
+		Next:     safeNext(next),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+	}
+	s.mu.Lock()
+	now := s.now()
+	for old, pending := range s.states {
+		if now.After(pending.expires) {
+			delete(s.states, old)
+		}
+	}
+	ls.expires = now.Add(loginTimeout)
+	s.states[id] = ls
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginStateCookie,
+		Value:    id,
+		Path:     "/auth/",
+		MaxAge:   int(loginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteLaxMode, // provider 에서 리다이렉트될 때도 전달되어야 함
+	})
+	return id, ls
+}
+
+// complete ends the login of provider whose state came back in the
+// callback. It fails unless the browser started that very login.
+func (s *stateStore) complete(w http.ResponseWriter, r *http.Request, provider, state string) (*loginState, error) {
+	http.SetCookie(w, &http.Cookie{Name: loginStateCookie, Value: "", Path: "/auth/", MaxAge: -1})
+	cookie, err := r.Cookie(loginStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return nil, ErrLoginState
+	}
+	s.mu.Lock()
+	ls, ok := s.states[state]
+	delete(s.states, state) // 한 번만 쓸 수 있다.
+	s.mu.Unlock()
+	if !ok || ls.Provider != provider || s.now().After(ls.expires) {
+		return nil, ErrLoginState
+	}
+	return ls, nil
+}
+
+// safeNext returns next if it is a path on this site, or defaultNext,
+// so the redirect after login cannot send users elsewhere. The path
+// and query come back escaped, so next can be put in pages and headers.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return defaultNext
+	}
+	// 제어 문자(CR/LF 등)가 있으면 url.Parse 가 실패한다.
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return defaultNext
+	}
+	u.RawQuery = u.Query().Encode()
+	return u.RequestURI()
+}
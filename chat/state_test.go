@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/stretchr/gomniauth"
+	gomniauthcommon "github.com/stretchr/gomniauth/common"
+	gomniauthtest "github.com/stretchr/gomniauth/test"
+	"github.com/stretchr/objx"
+)
+
+// callbackRequest makes the callback request of a browser that got the
+// cookies of w, or of another browser if w is nil.
+func callbackRequest(target string, w *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if w != nil {
+		for _, cookie := range w.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+	}
+	return req
+}
+
+func TestStateStore(t *testing.T) {
+	s := newStateStore()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	begun := httptest.NewRecorder()
+	state, ls := s.begin(begun, "github", "/chat?room=dev")
+	if ls.Next != "/chat?room=dev" || ls.Nonce == "" || ls.Verifier == "" {
+		t.Errorf("begin wrongly returned %+v", ls)
+	}
+	if _, err := s.complete(httptest.NewRecorder(), callbackRequest("/", nil), "github", state); err != ErrLoginState {
+		t.Errorf("complete should refuse another browser, got %v", err)
+	}
+	if _, err := s.complete(httptest.NewRecorder(), callbackRequest("/", begun), "google", state); err != ErrLoginState {
+		t.Errorf("complete should refuse another provider, got %v", err)
+	}
+
+	begun = httptest.NewRecorder()
+	state, _ = s.begin(begun, "github", "")
+	if got, err := s.complete(httptest.NewRecorder(), callbackRequest("/", begun), "github", state); err != nil || got.Next != defaultNext {
+		t.Errorf("complete wrongly returned %+v, %v", got, err)
+	}
+	if _, err := s.complete(httptest.NewRecorder(), callbackRequest("/", begun), "github", state); err != ErrLoginState {
+		t.Errorf("complete should refuse a used state, got %v", err)
+	}
+
+	begun = httptest.NewRecorder()
+	state, _ = s.begin(begun, "github", "")
+	now = now.Add(loginTimeout + time.Second)
+	if _, err := s.complete(httptest.NewRecorder(), callbackRequest("/", begun), "github", state); err != ErrLoginState {
+		t.Errorf("complete should refuse an expired state, got %v", err)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for next, want := range map[string]string{
+		"":                    defaultNext,
+		"/chat?room=dev":      "/chat?room=dev",
+		"/upload":             "/upload",
+		"https://evil.com/":   defaultNext,
+		"//evil.com/":         defaultNext,
+		"/\\evil.com/":        defaultNext,
+		"chat":                defaultNext,
+		"/chat\r\nSet-Cookie": defaultNext,
+		"/x\"><script>":       "/x%22%3E%3Cscript%3E",
+		"/chat?room=<b>":      "/chat?room=%3Cb%3E",
+		"http:/chat":          defaultNext,
+	} {
+		if got := safeNext(next); got != want {
+			t.Errorf("safeNext(%q) wrongly returned %q", next, got)
+		}
+	}
+}
+
+func TestLoginPageEscapesNext(t *testing.T) {
+	defer func(old *localAccounts) { accounts = old }(accounts)
+	defer func(old []string) { loginProviders = old }(loginProviders)
+	var err error
+	if accounts, err = newLocalAccounts(NewMemoryUserStore(), bcrypt.MinCost); err != nil {
+		t.Fatal(err)
+	}
+	loginProviders = []string{"github"}
+
+	for _, next := range []string{`/x"><script>alert(1)</script>`, `/chat?room="><script>alert(1)</script>`} {
+		w := httptest.NewRecorder()
+		(&templateHandler{filename: "login.html"}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login?next="+url.QueryEscape(next), nil))
+		body := w.Body.String()
+		if strings.Contains(body, "<script>") || strings.Contains(body, "alert(1)") {
+			t.Errorf("login page should escape next %q, got\n%s", next, body)
+		}
+		if !strings.Contains(body, `name="next" value="/`) || !strings.Contains(body, "/auth/login/github?next=%2f") {
+			t.Errorf("login page should still carry next %q, got\n%s", next, body)
+		}
+	}
+}
+
+// fakeProvider is a gomniauth provider that puts the state it is given
+// in its login URL like the real OAuth2 providers.
+type fakeProvider struct {
+	user    gomniauthcommon.User
+	userErr error
+}
+
+func (*fakeProvider) Name() string        { return "fake" }
+func (*fakeProvider) DisplayName() string { return "Fake" }
+func (*fakeProvider) GetBeginAuthURL(state *gomniauthcommon.State, options objx.Map) (string, error) {
+	signed, err := state.SignedBase64(gomniauth.GetSecurityKey())
+	if err != nil {
+		return "", err
+	}
+	return "https://fake.example.com/authorize?state=" + url.QueryEscape(signed), nil
+}
+func (*fakeProvider) CompleteAuth(data objx.Map) (*gomniauthcommon.Credentials, error) {
+	return &gomniauthcommon.Credentials{Map: data}, nil
+}
+func (p *fakeProvider) GetUser(creds *gomniauthcommon.Credentials) (gomniauthcommon.User, error) {
+	return p.user, p.userErr
+}
+func (*fakeProvider) GetClient(creds *gomniauthcommon.Credentials) (*http.Client, error) {
+	return http.DefaultClient, nil
+}
+
+func TestLoginHandler(t *testing.T) {
+	newTestSession(t, "setup") // tokens and sessions
+	gomniauth.SetSecurityKey("test key")
+	user := &gomniauthtest.TestUser{}
+	user.On("Email").Return("alice@example.com")
+	user.On("Name").Return("Alice")
+	user.On("AvatarURL").Return("")
+	provider := &fakeProvider{user: user}
+	gomniauth.WithProviders(provider)
+
+	for _, path := range []string{"/auth/nonsense", "/auth/", "/auth/login", "/auth/login/", "/auth/login/fake/extra", "/auth/logout/fake", "/auth/login/unknown"} {
+		w := httptest.NewRecorder()
+		loginHandler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: loginHandler wrongly returned %d", path, w.Code)
+		}
+	}
+
+	login := func(next string) (*httptest.ResponseRecorder, string) {
+		w := httptest.NewRecorder()
+		loginHandler(w, httptest.NewRequest(http.MethodGet, "/auth/login/fake?next="+url.QueryEscape(next), nil))
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("login wrongly returned %d", w.Code)
+		}
+		u, _ := url.Parse(w.Header().Get("Location"))
+		return w, "/auth/callback/fake?code=x&state=" + url.QueryEscape(u.Query().Get("state"))
+	}
+
+	begun, callback := login("/chat?room=dev")
+	w := httptest.NewRecorder()
+	loginHandler(w, callbackRequest(callback, begun))
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/chat?room=dev" {
+		t.Errorf("callback wrongly returned %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// login CSRF: the attacker's callback opened in the victim's browser
+	_, callback = login("/chat")
+	w = httptest.NewRecorder()
+	loginHandler(w, callbackRequest(callback, nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "expired") {
+		t.Errorf("callback from another browser should be refused, got %d", w.Code)
+	}
+
+	// an open redirect is not followed
+	begun, callback = login("https://evil.example.com/")
+	w = httptest.NewRecorder()
+	loginHandler(w, callbackRequest(callback, begun))
+	if w.Header().Get("Location") != defaultNext {
+		t.Errorf("callback should not redirect off site, went to %s", w.Header().Get("Location"))
+	}
+
+	// a provider failure shows an error page instead of stopping the server
+	provider.userErr = errors.New("provider is down")
+	begun, callback = login("/chat")
+	w = httptest.NewRecorder()
+	loginHandler(w, callbackRequest(callback, begun))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("callback should show an error page, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "provider is down") {
+		t.Error("error page should not show internal details")
+	}
+}
+
+func TestAuthHandlerNext(t *testing.T) {
+	h := MustAuth(http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/chat?room=dev", nil))
+	if loc := w.Header().Get("Location"); loc != "/login?next="+url.QueryEscape("/chat?room=dev") {
+		t.Errorf("authHandler wrongly redirected to %s", loc)
+	}
+}
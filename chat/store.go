@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidRoomKey is returned by FileStore for a room key that is not
+// a plain file name.
+var ErrInvalidRoomKey = errors.New("chat: invalid room key")
+
+// MessageStore keeps the history of messages sent to rooms.
+// Edits, deletions and reactions are stored too, as records that
+// change the message they target (edit.go).
+type MessageStore interface {
+	// Append records a message forwarded in the named room and sets its
+	// Seq to the next sequence number of the room. A message that has a
+	// Seq already, given by the broker, keeps it and the sequence of the
+	// room goes on from there.
+	Append(room string, msg *message) error
+	// Before returns at most n messages of the room sent before
+	// the given time, oldest first. A zero time means "now".
+	Before(room string, before time.Time, n int) ([]*message, error)
+	// Since returns at most n records of the room, changes included,
+	// whose Seq is after seq, oldest first. A client that got seq can
+	// apply them to catch up.
+	Since(room string, seq int64, n int) ([]*message, error)
+	// Lookup returns the message of the room with the given ID, with
+	// the changes made to it, or ErrNoMessage.
+	Lookup(room, id string) (*message, error)
+	// Thread returns the message of the room with the given ID followed
+	// by its replies, oldest first, or ErrNoMessage.
+	Thread(room, id string) ([]*message, error)
+	// LastSeq returns the last sequence number of the room, 0 if it
+	// has no history.
+	LastSeq(room string) (int64, error)
+}
+
+// lastMessages returns the n most recent messages of the room.
+func lastMessages(s MessageStore, room string, n int) ([]*message, error) {
+	return s.Before(room, time.Time{}, n)
+}
+
+// selectBefore picks at most n messages from msgs (oldest first)
+// that were sent before the given time.
+func selectBefore(msgs []*message, before time.Time, n int) []*message {
+	end := len(msgs)
+	if !before.IsZero() {
+		for end > 0 && !msgs[end-1].When.Before(before) {
+			end--
+		}
+	}
+	start := end - n
+	if start < 0 {
+		start = 0
+	}
+	result := make([]*message, end-start)
+	copy(result, msgs[start:end])
+	return result
+}
+
+// removeMessage returns msgs without the message a deletion is about.
+func removeMessage(msgs []*message, deleted *message) []*message {
+	if i := indexMessage(msgs, deleted.Target); i >= 0 {
+		return append(msgs[:i:i], msgs[i+1:]...)
+	}
+	return msgs
+}
+
+// applyRecords turns stored records (oldest first) into the messages
+// they leave, applying the changes.
+func applyRecords(records []*message) []*message {
+	msgs := make([]*message, 0, len(records))
+	for _, record := range records {
+		switch record.Type {
+		case typeDelete:
+			msgs = removeMessage(msgs, record)
+		case typeEdit, typeReaction:
+			if i := indexMessage(msgs, record.Target); i >= 0 {
+				msgs[i] = applyChange(msgs[i], record)
+			}
+		default:
+			msgs = append(msgs, record)
+		}
+	}
+	countReplies(msgs)
+	return msgs
+}
+
+// indexMessage returns the index of the message with the ID in msgs, or -1.
+func indexMessage(msgs []*message, id string) int {
+	for i, msg := range msgs {
+		if msg.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookupMessage finds the message with the ID in records.
+func lookupMessage(records []*message, id string) (*message, error) {
+	msgs := applyRecords(records)
+	if i := indexMessage(msgs, id); i >= 0 {
+		return msgs[i], nil
+	}
+	return nil, ErrNoMessage
+}
+
+// selectSince picks the first n records after seq.
+func selectSince(records []*message, seq int64, n int) []*message {
+	var result []*message
+	for _, record := range records {
+		if record.Seq > seq && len(result) < n {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// nextSeq numbers msg after last, unless it has a Seq already, and
+// returns the last sequence number of the room after it.
+func nextSeq(last int64, msg *message) int64 {
+	if msg.Seq == 0 {
+		msg.Seq = last + 1
+	}
+	if msg.Seq > last {
+		return msg.Seq
+	}
+	return last
+}
+
+// RingBufferStore keeps the last size records of every room in memory.
+type RingBufferStore struct {
+	mu    sync.Mutex
+	size  int
+	rooms map[string][]*message
+	// seqs are the last sequence numbers of the rooms.
+	seqs map[string]int64
+}
+
+// NewRingBufferStore makes a RingBufferStore holding up to size
+// records per room.
+func NewRingBufferStore(size int) *RingBufferStore {
+	return &RingBufferStore{size: size, rooms: make(map[string][]*message), seqs: make(map[string]int64)}
+}
+
+// Append is ...
+func (s *RingBufferStore) Append(room string, msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seqs[room] = nextSeq(s.seqs[room], msg)
+	msgs := append(s.rooms[room], msg)
+	if len(msgs) > s.size {
+		// 오래된 메세지를 버린다. 새 슬라이스로 복사해서 앞쪽 배열이 계속 남지 않게 함
+		msgs = append([]*message(nil), msgs[len(msgs)-s.size:]...)
+	}
+	s.rooms[room] = msgs
+	return nil
+}
+
+// Before is ...
+func (s *RingBufferStore) Before(room string, before time.Time, n int) ([]*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return selectBefore(applyRecords(s.rooms[room]), before, n), nil
+}
+
+// Since is ...
+func (s *RingBufferStore) Since(room string, seq int64, n int) ([]*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return selectSince(s.rooms[room], seq, n), nil
+}
+
+// Lookup is ...
+func (s *RingBufferStore) Lookup(room, id string) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return lookupMessage(s.rooms[room], id)
+}
+
+// Thread is ...
+func (s *RingBufferStore) Thread(room, id string) ([]*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return selectThread(applyRecords(s.rooms[room]), id)
+}
+
+// LastSeq is ...
+func (s *RingBufferStore) LastSeq(room string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seqs[room], nil
+}
+
+// maxFileRooms is how many rooms a FileStore keeps in memory. The least
+// recently used ones are read from their file again when needed.
+const maxFileRooms = 64
+
+// FileStore appends the messages of every room to a JSON lines
+// file named {room}.jsonl in its directory. The files of the rooms in
+// use are read once; after that their history is served from memory.
+type FileStore struct {
+	mu    sync.Mutex
+	dir   string
+	rooms map[string]*fileRoom
+	// clock counts the uses of rooms, to find the least recently used.
+	clock uint64
+}
+
+// fileRoom is the history of a room in a FileStore, kept up to date by
+// Append after it is read from the file.
+type fileRoom struct {
+	// f is the append handle, opened on first use.
+	f *os.File
+	// seq is the last sequence number of the room.
+	seq int64
+	// records are all records of the room, changes included, oldest
+	// first. Since returns them.
+	records []*message
+	// msgs are the messages the records leave (applyRecords), or nil if
+	// they have to be worked out again, and index their positions by ID.
+	msgs  []*message
+	index map[string]int
+	// used is the clock of the FileStore when the room was last used.
+	used uint64
+}
+
+// NewFileStore makes a FileStore writing into dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, rooms: make(map[string]*fileRoom)}, nil
+}
+
+// filename returns the file of the room. Room keys come from requests
+// (e.g. /history?with=), so keys that could leave dir are refused.
+func (s *FileStore) filename(room string) (string, error) {
+	if room == "" || strings.ContainsAny(room, `/\`) || strings.Contains(room, "..") {
+		return "", ErrInvalidRoomKey
+	}
+	return filepath.Join(s.dir, room+".jsonl"), nil
+}
+
+// room returns the history of the room, reading its file if it is not
+// in memory. Rooms without a file are only kept if create is true, so
+// looking up unknown rooms does not fill the memory. s.mu must be held.
+func (s *FileStore) room(name string, create bool) (*fileRoom, error) {
+	s.clock++
+	if fr, ok := s.rooms[name]; ok {
+		fr.used = s.clock
+		return fr, nil
+	}
+	filename, err := s.filename(name)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readRecords(filename)
+	if err != nil {
+		return nil, err
+	}
+	fr := &fileRoom{records: records, used: s.clock}
+	for _, record := range records {
+		if record.Seq > fr.seq {
+			fr.seq = record.Seq
+		}
+	}
+	if records != nil || create {
+		s.evict()
+		s.rooms[name] = fr
+	}
+	return fr, nil
+}
+
+// evict makes room for one more room in memory by dropping the least
+// recently used one if needed. s.mu must be held.
+func (s *FileStore) evict() {
+	if len(s.rooms) < maxFileRooms {
+		return
+	}
+	var oldest string
+	for name, fr := range s.rooms {
+		if oldest == "" || fr.used < s.rooms[oldest].used {
+			oldest = name
+		}
+	}
+	if f := s.rooms[oldest].f; f != nil {
+		f.Close()
+	}
+	delete(s.rooms, oldest)
+}
+
+// Append is ...
+func (s *FileStore) Append(room string, msg *message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fr, err := s.room(room, true)
+	if err != nil {
+		return err
+	}
+	if fr.f == nil {
+		filename, _ := s.filename(room)
+		fr.f, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	// 이어서 번호를 매긴다.
+	fr.seq = nextSeq(fr.seq, msg)
+	if err := json.NewEncoder(fr.f).Encode(msg); err != nil {
+		return err
+	}
+	fr.add(msg)
+	return nil
+}
+
+// Close flushes the files to disk and closes them.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, fr := range s.rooms {
+		if fr.f == nil {
+			continue
+		}
+		if err := fr.f.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := fr.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		fr.f = nil
+	}
+	return firstErr
+}
+
+// Before is ...
+func (s *FileStore) Before(room string, before time.Time, n int) ([]*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fr, err := s.room(room, false)
+	if err != nil {
+		return nil, err
+	}
+	return selectBefore(fr.messages(), before, n), nil
+}
+
+// Since is ...
+func (s *FileStore) Since(room string, seq int64, n int) ([]*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fr, err := s.room(room, false)
+	if err != nil {
+		return nil, err
+	}
+	return selectSince(fr.records, seq, n), nil
+}
+
+// Lookup is ...
+func (s *FileStore) Lookup(room, id string) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fr, err := s.room(room, false)
+	if err != nil {
+		return nil, err
+	}
+	msgs := fr.messages()
+	if i, ok := fr.index[id]; ok {
+		return msgs[i], nil
+	}
+	return nil, ErrNoMessage
+}
+
+// Thread is ...
+func (s *FileStore) Thread(room, id string) ([]*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fr, err := s.room(room, false)
+	if err != nil {
+		return nil, err
+	}
+	return selectThread(fr.messages(), id)
+}
+
+// LastSeq is ...
+func (s *FileStore) LastSeq(room string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fr, err := s.room(room, false)
+	if err != nil {
+		return 0, err
+	}
+	return fr.seq, nil
+}
+
+// messages returns the messages the records of the room leave, working
+// them out again if a record changed them.
+func (fr *fileRoom) messages() []*message {
+	if fr.msgs == nil {
+		fr.msgs = applyRecords(fr.records)
+		fr.index = make(map[string]int, len(fr.msgs))
+		for i, msg := range fr.msgs {
+			// indexMessage 처럼 같은 ID 가 여럿이면 처음 것을 찾는다.
+			if _, ok := fr.index[msg.ID]; !ok {
+				fr.index[msg.ID] = i
+			}
+		}
+	}
+	return fr.msgs
+}
+
+// add adds a new record. Edits, reactions and new messages outside
+// threads are applied like applyRecords does; deletions and replies
+// change the threads, so the messages are worked out again when needed.
+// Messages in msgs may have been handed out and are never changed.
+func (fr *fileRoom) add(record *message) {
+	fr.records = append(fr.records, record)
+	if fr.msgs == nil {
+		return
+	}
+	switch {
+	case record.Type == typeEdit || record.Type == typeReaction:
+		if i, ok := fr.index[record.Target]; ok {
+			fr.msgs[i] = applyChange(fr.msgs[i], record)
+		}
+	case record.Type != typeDelete && record.Parent == "":
+		if _, ok := fr.index[record.ID]; !ok {
+			fr.index[record.ID] = len(fr.msgs)
+		}
+		fr.msgs = append(fr.msgs, record)
+	default:
+		fr.msgs, fr.index = nil, nil
+	}
+}
+
+// readRecords reads every record of a FileStore file.
+func readRecords(filename string) ([]*message, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			// 중간에 깨진 줄(예: 쓰다가 죽은 경우)은 건너뛴다.
+			continue
+		}
+		records = append(records, &msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testMessageStore(t *testing.T, store MessageStore) {
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		msg := &message{Name: "abc", Message: string('a' + rune(i)), When: start.Add(time.Duration(i) * time.Second)}
+		if err := store.Append("room", msg); err != nil {
+			t.Fatalf("Append should not return an error: %s", err)
+		}
+	}
+
+	if msgs, _ := store.Since("room", 0, 10); len(msgs) != 5 || msgs[0].Seq != 1 || msgs[4].Seq != 5 {
+		t.Errorf("Append should number the messages from 1, got %v", msgs)
+	}
+	if msgs, _ := store.Since("room", 3, 10); len(msgs) != 2 || msgs[0].Message != "d" {
+		t.Errorf("Since wrongly returned %v", msgs)
+	}
+
+	msgs, err := lastMessages(store, "room", 2)
+	if err != nil {
+		t.Fatalf("Before should not return an error: %s", err)
+	}
+	if len(msgs) != 2 || msgs[0].Message != "d" || msgs[1].Message != "e" {
+		t.Errorf("lastMessages wrongly returned %v", msgs)
+	}
+
+	msgs, _ = store.Before("room", start.Add(2*time.Second), 10)
+	if len(msgs) != 2 || msgs[0].Message != "a" || msgs[1].Message != "b" {
+		t.Errorf("Before wrongly returned %v", msgs)
+	}
+
+	if msgs, _ := store.Before("other", time.Time{}, 10); len(msgs) != 0 {
+		t.Errorf("Before should return nothing for an unknown room, got %v", msgs)
+	}
+
+	// deletions remove the message from the history
+	store.Append("deleted", &message{ID: "1", Message: "keep"})
+	store.Append("deleted", &message{ID: "2", Message: "spam"})
+	store.Append("deleted", &message{Type: typeDelete, Action: actionDelete, Target: "2"})
+	if msgs, _ := lastMessages(store, "deleted", 10); len(msgs) != 1 || msgs[0].Message != "keep" {
+		t.Errorf("deleted message should be gone from the history, got %v", msgs)
+	}
+	// 이어받는 클라이언트는 삭제도 받아야 한다.
+	if msgs, _ := store.Since("deleted", 1, 10); len(msgs) != 2 || msgs[1].Type != typeDelete {
+		t.Errorf("Since should return the deletion, got %v", msgs)
+	}
+}
+
+func TestRingBufferStore(t *testing.T) {
+	testMessageStore(t, NewRingBufferStore(10))
+
+	store := NewRingBufferStore(3)
+	for i := 0; i < 5; i++ {
+		store.Append("room", &message{Message: string('a' + rune(i))})
+	}
+	msgs, _ := lastMessages(store, "room", 10)
+	if len(msgs) != 3 || msgs[0].Message != "c" {
+		t.Errorf("RingBufferStore should only keep the last 3 messages, got %v", msgs)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore should not return an error: %s", err)
+	}
+	testMessageStore(t, store)
+	// 한번 읽은 기록은 메모리에서 찾는다.
+	os.Rename(filepath.Join(dir, "room.jsonl"), filepath.Join(dir, "moved"))
+	if msgs, _ := lastMessages(store, "room", 10); len(msgs) != 5 {
+		t.Errorf("FileStore should not read the file again, got %v", msgs)
+	}
+	os.Rename(filepath.Join(dir, "moved"), filepath.Join(dir, "room.jsonl"))
+	store.Close()
+
+	// 다시 열면 번호를 이어서 매긴다.
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &message{Message: "f"}
+	if err := store.Append("room", msg); err != nil || msg.Seq != 6 {
+		t.Errorf("Append after reopening should continue at 6, got %d, %v", msg.Seq, err)
+	}
+	// 오래 쓰지 않은 룸은 메모리에서 내보내고 필요하면 다시 읽는다.
+	for i := 0; i < maxFileRooms+5; i++ {
+		store.Append(fmt.Sprintf("busy%d", i), &message{Message: "x"})
+	}
+	if len(store.rooms) > maxFileRooms {
+		t.Errorf("FileStore should keep at most %d rooms in memory, has %d", maxFileRooms, len(store.rooms))
+	}
+	if msgs, _ := lastMessages(store, "room", 10); len(msgs) != 6 || msgs[5].Message != "f" {
+		t.Errorf("an evicted room should be read again, got %v", msgs)
+	}
+	store.Append("busy0", &message{Message: "y"})
+	if msgs, _ := lastMessages(store, "busy0", 10); len(msgs) != 2 || msgs[1].Seq != 2 {
+		t.Errorf("an evicted room should go on with its numbering, got %v", msgs)
+	}
+	for _, key := range []string{"../escape", "~~/../@alice+bob", `a\b`, ".."} {
+		if err := store.Append(key, &message{Message: "x"}); err != ErrInvalidRoomKey {
+			t.Errorf("Append(%q) should return ErrInvalidRoomKey, got %v", key, err)
+		}
+		if _, err := store.Before(key, time.Time{}, 10); err != ErrInvalidRoomKey {
+			t.Errorf("Before(%q) should return ErrInvalidRoomKey, got %v", key, err)
+		}
+	}
+	store.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// countReplies sets Replies and LastReply on the messages of msgs that
+// have replies in msgs. The messages are replaced by copies, since the
+// stored ones may be shared.
+func countReplies(msgs []*message) {
+	roots := make(map[string]int)
+	for i, msg := range msgs {
+		if msg.Parent == "" {
+			roots[msg.ID] = i
+		}
+	}
+	copied := make(map[int]bool)
+	for _, msg := range msgs {
+		i, ok := roots[msg.Parent]
+		if msg.Parent == "" || !ok {
+			continue
+		}
+		if !copied[i] {
+			root := *msgs[i]
+			root.Replies, root.LastReply = 0, nil
+			msgs[i] = &root
+			copied[i] = true
+		}
+		root := msgs[i]
+		root.Replies++
+		if root.LastReply == nil || msg.When.After(*root.LastReply) {
+			when := msg.When
+			root.LastReply = &when
+		}
+	}
+}
+
+// selectThread picks the message with the ID and its replies from msgs.
+func selectThread(msgs []*message, id string) ([]*message, error) {
+	i := indexMessage(msgs, id)
+	if i < 0 || msgs[i].Parent != "" {
+		return nil, ErrNoMessage
+	}
+	thread := []*message{msgs[i]}
+	for _, msg := range msgs[i+1:] {
+		if msg.Parent == id {
+			thread = append(thread, msg)
+		}
+	}
+	return thread, nil
+}
+
+// attachReply checks that the parent of a reply is in the room. Replies
+// to a reply go to the same thread, so threads are never nested.
+func (r *room) attachReply(msg *message) error {
+	parent, err := r.store.Lookup(r.name, msg.Parent)
+	if err != nil {
+		return err
+	}
+	if parent.Parent != "" {
+		msg.Parent = parent.Parent
+	}
+	return nil
+}
+
+// announceThread tells the room the new summary of the thread of the
+// message with the given ID, after a reply was added or deleted.
+func (r *room) announceThread(id string) {
+	root, err := r.store.Lookup(r.name, id)
+	if err != nil {
+		r.tracer.Trace("Failed to load thread: ", err)
+		return
+	}
+	r.broadcast(threadMessage(root), "")
+}
+
+// threadMessage makes a thread event with the summary of root's thread.
+func threadMessage(root *message) *message {
+	return &message{
+		V:         protocolVersion,
+		Type:      typeThread,
+		Target:    root.ID,
+		Replies:   root.Replies,
+		LastReply: root.LastReply,
+		When:      time.Now(),
+	}
+}
+
+// threadResponse is the JSON of /rooms/{name}/threads/{id}.
+type threadResponse struct {
+	Root    *message   `json:"root"`
+	Replies []*message `json:"replies"`
+}
+
+// serveThread serves the thread of the message with the given ID in the room.
+// roomHandler has already refused users banned from the room.
+func serveThread(w http.ResponseWriter, req *http.Request, store MessageStore, room, id string) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	msgs, err := store.Thread(room, id)
+	if err == ErrNoMessage {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(threadResponse{Root: msgs[0], Replies: append([]*message{}, msgs[1:]...)})
+}
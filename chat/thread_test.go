@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStoreThreads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileStore, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+
+	now := time.Now()
+	for name, store := range map[string]MessageStore{"ring": NewRingBufferStore(10), "file": fileStore} {
+		store.Append("room", &message{Type: typeChat, ID: "root", Message: "lunch?", When: now})
+		store.Append("room", &message{Type: typeChat, ID: "r1", Parent: "root", Message: "yes", When: now.Add(time.Second)})
+		store.Append("room", &message{Type: typeChat, ID: "other", Message: "hi", When: now.Add(2 * time.Second)})
+		store.Append("room", &message{Type: typeChat, ID: "r2", Parent: "root", Message: "pizza", When: now.Add(3 * time.Second)})
+		store.Append("room", &message{Type: typeChat, ID: "r3", Parent: "root", Message: "no", When: now.Add(4 * time.Second)})
+		store.Append("room", &message{Type: typeDelete, Target: "r3", Parent: "root"})
+
+		root, err := store.Lookup("room", "root")
+		if err != nil || root.Replies != 2 || !root.LastReply.Equal(now.Add(3*time.Second)) {
+			t.Errorf("%s: root should have 2 replies, got %+v, %v", name, root, err)
+		}
+		thread, err := store.Thread("room", "root")
+		if err != nil || len(thread) != 3 || thread[0].ID != "root" || thread[1].ID != "r1" || thread[2].ID != "r2" {
+			t.Errorf("%s: Thread wrongly returned %v, %v", name, thread, err)
+		}
+		for _, id := range []string{"r1", "nope"} {
+			if _, err := store.Thread("room", id); err != ErrNoMessage {
+				t.Errorf("%s: Thread(%q) should return ErrNoMessage, got %v", name, id, err)
+			}
+		}
+	}
+
+	// 파일에서 다시 읽어도 Append 로 쌓은 것과 같다.
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := reopened.Lookup("room", "root")
+	if err != nil || root.Replies != 2 || !root.LastReply.Equal(now.Add(3*time.Second)) {
+		t.Errorf("reopened store should count 2 replies, got %+v, %v", root, err)
+	}
+	if thread, _ := reopened.Thread("room", "root"); len(thread) != 3 {
+		t.Errorf("reopened store wrongly returned the thread %v", thread)
+	}
+}
+
+func TestRoomThreads(t *testing.T) {
+	r := newRoom()
+	r.name = "test"
+	go r.run()
+	defer close(r.quit)
+	alice := newTestUserClient(t, r, "alice")
+	bob := newTestUserClient(t, r, "bob")
+	r.join <- alice
+	r.join <- bob
+	receive(t, alice, 1) // bob joined
+
+	send := func(c *client, msg *message) {
+		msg.UserID, msg.from, msg.When = c.userID(), c, time.Now()
+		r.forward <- msg
+		waitForRoom(r)
+	}
+	send(alice, &message{Type: typeChat, ID: "root", Message: "lunch?"})
+	receive(t, bob, 1)
+	send(bob, &message{Type: typeChat, ID: "r1", Parent: "root", Message: "yes"})
+	msgs := receive(t, alice, 3)
+	if msgs[1].Type != typeChat || msgs[1].Parent != "root" {
+		t.Errorf("room should get the reply, got %+v", msgs[1])
+	}
+	if msgs[2].Type != typeThread || msgs[2].Target != "root" || msgs[2].Replies != 1 || msgs[2].LastReply == nil {
+		t.Errorf("room should be told about the new reply count, got %+v", msgs[2])
+	}
+	receive(t, bob, 2)
+
+	// 답글에 단 답글은 같은 스레드로 간다.
+	send(alice, &message{Type: typeChat, ID: "r2", Parent: "r1", Message: "pizza"})
+	if msgs := receive(t, bob, 2); msgs[0].Parent != "root" || msgs[1].Replies != 2 {
+		t.Errorf("reply to a reply should go to the root, got %+v, %+v", msgs[0], msgs[1])
+	}
+	receive(t, alice, 2)
+
+	send(bob, &message{Type: typeDelete, Target: "r1"})
+	if msgs := receive(t, alice, 2); msgs[1].Type != typeThread || msgs[1].Replies != 1 {
+		t.Errorf("deleting a reply should update the thread, got %+v", msgs)
+	}
+	receive(t, bob, 2)
+
+	send(bob, &message{Type: typeChat, Parent: "gone", Message: "hm"})
+	if msgs := receive(t, bob, 1); msgs[0].Type != typeError || msgs[0].Message != ErrNoMessage.Error() {
+		t.Errorf("reply to an unknown message should get an error, got %+v", msgs[0])
+	}
+	if len(alice.send) != 0 {
+		t.Error("reply to an unknown message should not be sent to the room")
+	}
+}
+
+func TestRoomHandlerThread(t *testing.T) {
+	registry := newRoomRegistry()
+	registry.store.Append("lobby", &message{Type: typeChat, ID: "root", Message: "lunch?"})
+	registry.store.Append("lobby", &message{Type: typeChat, ID: "r1", Parent: "root", Message: "yes"})
+	h := &roomHandler{registry: registry}
+	cookie := newTestSession(t, "alice")
+	get := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.AddCookie(cookie)
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, get("/rooms/lobby/threads/root"))
+	var thread threadResponse
+	if err := json.NewDecoder(w.Body).Decode(&thread); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || thread.Root.Replies != 1 || len(thread.Replies) != 1 || thread.Replies[0].ID != "r1" {
+		t.Errorf("wrong thread: %d %+v", w.Code, thread)
+	}
+	for _, path := range []string{"/rooms/lobby/threads/r1", "/rooms/lobby/threads/nope", "/rooms/kitchen/threads/root", "/rooms/lobby/nothing"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, get(path))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s should be not found, got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stretchr/objx"
+)
+
+// authCookieName is the name of the cookie holding the auth token.
+const authCookieName = "auth"
+
+// ErrInvalidToken is returned when an auth token was not issued by
+// this server or has been tampered with.
+var ErrInvalidToken = errors.New("chat: invalid auth token")
+
+// ErrExpiredToken is returned when an auth token is past its expiry.
+var ErrExpiredToken = errors.New("chat: auth token expired")
+
+// tokens signs and verifies the auth cookie. It is set up in main.
+var tokens *tokenCodec
+
+// secureCookies marks cookies as Secure (HTTPS only).
+var secureCookies bool
+
+// tokenPayload is what gets signed into an auth token.
+type tokenPayload struct {
+	Data     map[string]interface{} `json:"d"`
+	IssuedAt int64                  `json:"iat"`
+	Expires  int64                  `json:"exp"`
+}
+
+// tokenCodec HMAC-signs, and optionally encrypts, auth tokens.
+// format: base64(payload) + "." + base64(hmac-sha256(payload))
+// 암호화를 켜면 payload 는 AES-GCM 으로 암호화된 nonce+ciphertext 이다.
+type tokenCodec struct {
+	signKey []byte
+	aead    cipher.AEAD // nil if tokens are only signed
+	maxAge  time.Duration
+	now     func() time.Time
+}
+
+// newTokenCodec derives the signing (and encryption) keys from secret.
+func newTokenCodec(secret []byte, encrypt bool, maxAge time.Duration) (*tokenCodec, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("chat: empty token secret")
+	}
+	c := &tokenCodec{
+		signKey: deriveKey(secret, "chat auth sign"),
+		maxAge:  maxAge,
+		now:     time.Now,
+	}
+	if encrypt {
+		block, err := aes.NewCipher(deriveKey(secret, "chat auth encrypt"))
+		if err != nil {
+			return nil, err
+		}
+		if c.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func deriveKey(secret []byte, label string) []byte {
+	m := hmac.New(sha256.New, secret)
+	io.WriteString(m, label)
+	return m.Sum(nil)
+}
+
+// randomSecret returns n random bytes, used when no key is configured.
+func randomSecret(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (c *tokenCodec) sign(b []byte) []byte {
+	m := hmac.New(sha256.New, c.signKey)
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// Encode makes a token for data that expires after maxAge.
+func (c *tokenCodec) Encode(data map[string]interface{}) (string, error) {
+	now := c.now()
+	body, err := json.Marshal(tokenPayload{
+		Data:     data,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(c.maxAge).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if c.aead != nil {
+		nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(body)+c.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		body = c.aead.Seal(nonce, nonce, body, nil)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(body) + "." + enc.EncodeToString(c.sign(body)), nil
+}
+
+// Decode verifies a token and returns the data it carries.
+func (c *tokenCodec) Decode(token string) (objx.Map, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+	enc := base64.RawURLEncoding
+	body, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac, err := enc.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, c.sign(body)) {
+		return nil, ErrInvalidToken
+	}
+	if c.aead != nil {
+		n := c.aead.NonceSize()
+		if len(body) < n {
+			return nil, ErrInvalidToken
+		}
+		if body, err = c.aead.Open(nil, body[:n], body[n:], nil); err != nil {
+			return nil, ErrInvalidToken
+		}
+	}
+	var payload tokenPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Data == nil {
+		return nil, ErrInvalidToken
+	}
+	if c.now().Unix() >= payload.Expires {
+		return nil, ErrExpiredToken
+	}
+	return objx.New(payload.Data), nil
+}
+
+// currentUser verifies the auth cookie of the request and returns the
+// user data of its session. This is the only place the cookie is trusted.
+func currentUser(r *http.Request) (objx.Map, error) {
+	sess, err := currentSession(r)
+	if err != nil {
+		return nil, err
+	}
+	return objx.New(sess.Data), nil
+}
+
+// setAuthCookie issues a signed auth cookie carrying data.
+func setAuthCookie(w http.ResponseWriter, data map[string]interface{}) error {
+	value, err := tokens.Encode(data)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(tokens.maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteLaxMode, // OAuth callback 에서 리다이렉트될 때도 쿠키가 전달되어야 함
+	})
+	return nil
+}
+
+// clearAuthCookie removes the auth cookie from the browser.
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCodec(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		codec, err := newTokenCodec([]byte("secret"), encrypt, time.Hour)
+		if err != nil {
+			t.Fatalf("newTokenCodec should not return an error: %s", err)
+		}
+		token, err := codec.Encode(map[string]interface{}{"userid": "abc", "name": "Jihui"})
+		if err != nil {
+			t.Fatalf("Encode should not return an error: %s", err)
+		}
+		if encrypt && strings.Contains(token, "abc") {
+			t.Error("Encrypted token should not contain the user data in clear")
+		}
+		data, err := codec.Decode(token)
+		if err != nil {
+			t.Fatalf("Decode should not return an error: %s", err)
+		}
+		if data.Get("userid").Str() != "abc" || data.Get("name").Str() != "Jihui" {
+			t.Errorf("Decode wrongly returned %v", data)
+		}
+
+		// tampering with any part must be detected
+		tampered := []byte(token)
+		tampered[len(tampered)/3] ^= 1
+		if _, err := codec.Decode(string(tampered)); err != ErrInvalidToken {
+			t.Errorf("Decode should return ErrInvalidToken for a tampered token, got %v", err)
+		}
+
+		other, _ := newTokenCodec([]byte("other secret"), encrypt, time.Hour)
+		if _, err := other.Decode(token); err != ErrInvalidToken {
+			t.Errorf("Decode should return ErrInvalidToken for a token signed with another key, got %v", err)
+		}
+
+		codec.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		if _, err := codec.Decode(token); err != ErrExpiredToken {
+			t.Errorf("Decode should return ErrExpiredToken for an old token, got %v", err)
+		}
+	}
+}
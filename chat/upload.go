@@ -1,32 +1,201 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif" // 디코딩만 지원
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"path"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
+const (
+	// maxAvatarUpload is the largest request body accepted by the uploader.
+	maxAvatarUpload = 5 << 20
+	// maxAvatarPixels guards against images that decode to huge bitmaps.
+	maxAvatarPixels = 4096 * 4096
+	// avatarSize is the side of the square thumbnail that is stored.
+	avatarSize = 256
+)
+
+// avatarExts are the extensions an avatar may have been stored under,
+// including by earlier versions of the uploader.
+var avatarExts = []string{".png", ".jpg", ".jpeg", ".gif"}
+
+// allowedAvatarTypes are the sniffed content types accepted for upload.
+var allowedAvatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+var (
+	// ErrAvatarTooLarge is returned when an upload exceeds maxAvatarUpload or maxAvatarPixels.
+	ErrAvatarTooLarge = errors.New("chat: avatar image is too large")
+	// ErrAvatarType is returned when an upload is not a supported image.
+	ErrAvatarType = errors.New("chat: avatar must be a PNG, JPEG or GIF image")
+)
+
+var uploadResult = template.Must(template.New("uploaded").Parse(`<html>
+    <head>
+        <title>Upload</title>
+        <link rel="stylesheet" href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.7/css/bootstrap.min.css" integrity="sha384-BVYiiSIFeK1dGmJRAkycuHAHRg32OmUcww7on3RYdg4Va+PmSTsz/K68vbdEjh4u" crossorigin="anonymous">
+    </head>
+    <body>
+        <div class="container">
+            <div class="page-header">
+                <h1>{{if .Error}}Upload failed{{else}}Picture uploaded{{end}}</h1>
+            </div>
+            {{if .Error}}<div class="alert alert-danger">{{.Error}}</div>{{else}}<img src="{{.AvatarURL}}" width="128" height="128" />{{end}}
+            <p><a href="/upload">Upload another</a> or <a href="/chat">back to chat</a></p>
+        </div>
+    </body>
+</html>`))
+
+// uploadResponse is the body of the uploader's response.
+type uploadResponse struct {
+	AvatarURL string `json:"avatar_url,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// uploaderHandler stores the current user's avatar.
+// format: POST /uploader (multipart avatarFile), JSON when Accept asks for it
 func uploaderHandler(w http.ResponseWriter, req *http.Request) {
-	userID := req.FormValue("userid")               // value from input hidden
-	file, header, err := req.FormFile("avatarFile") // file from form
+	// userID := req.FormValue("userid")               // value from input hidden
+	// 폼의 userid 는 누구나 바꿀 수 있으므로 세션의 사용자로 저장한다.
+	sess, err := currentSession(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeUploadResult(w, req, http.StatusUnauthorized, uploadResponse{Error: err.Error()})
 		return
 	}
+	if req.Method != http.MethodPost {
+		writeUploadResult(w, req, http.StatusMethodNotAllowed, uploadResponse{Error: "method not allowed"})
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxAvatarUpload)
+	file, _, err := req.FormFile("avatarFile") // file from form
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			status, err = http.StatusRequestEntityTooLarge, ErrAvatarTooLarge
+		}
+		writeUploadResult(w, req, status, uploadResponse{Error: err.Error()})
+		return
+	}
+	defer file.Close()
 
-	data, err := ioutil.ReadAll(file)
+	// data, err := ioutil.ReadAll(file)
+	img, err := decodeAvatar(file)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := http.StatusUnsupportedMediaType
+		if errors.Is(err, ErrAvatarTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeUploadResult(w, req, status, uploadResponse{Error: err.Error()})
 		return
 	}
 
-	filename := path.Join("avatars", userID+path.Ext(header.Filename))
-	err = ioutil.WriteFile(filename, data, 0777)
+	// filename := path.Join(avatarsDir, userID+path.Ext(header.Filename))
+	// err = ioutil.WriteFile(filename, data, 0777)
+	name, err := saveAvatar(avatarsDir, sess.UserID, img)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeUploadResult(w, req, http.StatusInternalServerError, uploadResponse{Error: err.Error()})
 		return
 	}
 
-	io.WriteString(w, "Successful")
+	// io.WriteString(w, "Successful")
+	writeUploadResult(w, req, http.StatusOK, uploadResponse{AvatarURL: "/avatars/" + name})
+}
+
+// decodeAvatar sniffs, checks and decodes an uploaded image.
+func decodeAvatar(r io.Reader) (image.Image, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: %s", ErrAvatarType, err)
+	}
+	head = head[:n]
+	// 파일 이름이나 클라이언트가 보낸 Content-Type 대신 내용으로 판단한다.
+	if !allowedAvatarTypes[http.DetectContentType(head)] {
+		return nil, ErrAvatarType
+	}
+
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(io.MultiReader(bytes.NewReader(head), r), &buf))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAvatarType, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, ErrAvatarTooLarge
+	}
+	img, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAvatarType, err)
+	}
+	return img, nil
+}
+
+// saveAvatar stores img as a square PNG named after userID in dir, replacing
+// any previous avatar of that user. It returns the file name.
+func saveAvatar(dir, userID string, img image.Image) (string, error) {
+	if !validAvatarID(userID) {
+		return "", fmt.Errorf("chat: invalid user ID %q for avatar", userID)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // rename 후에는 아무 일도 하지 않는다.
+	if err := png.Encode(tmp, squareThumbnail(img, avatarSize)); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	name := userID + ".png"
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	// 예전 확장자로 남은 파일이 있으면 FileSystemAvatar 가 그것을 고를 수 있다.
+	for _, ext := range avatarExts {
+		if old := userID + ext; old != name {
+			if err := os.Remove(filepath.Join(dir, old)); err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+	return name, nil
+}
+
+// writeUploadResult answers with JSON or an HTML page depending on Accept.
+func writeUploadResult(w http.ResponseWriter, req *http.Request, status int, res uploadResponse) {
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	uploadResult.Execute(w, res)
 }
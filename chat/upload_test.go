@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSession sets up the global tokens and sessions and returns a
+// cookie for a session of userID.
+func newTestSession(t *testing.T, userID string) *http.Cookie {
+	codec, err := newTokenCodec([]byte("test secret"), false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens = codec
+	if sessions == nil {
+		sessions = newSessionManager(NewMemorySessionStore(), time.Hour, 24*time.Hour)
+	}
+	sess, err := sessions.Create(map[string]interface{}{"userid": userID}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := tokens.Encode(map[string]interface{}{"sid": sess.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: authCookieName, Value: value}
+}
+
+func newUploadRequest(t *testing.T, data []byte, cookie *http.Cookie) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("avatarFile", "picture.png")
+	part.Write(data)
+	// 예전 폼처럼 userid 를 보내도 무시되어야 한다.
+	form.WriteField("userid", "someone-else")
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/uploader", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestUploaderHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avatars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { avatarsDir = old }(avatarsDir)
+	avatarsDir = dir
+	ioutil.WriteFile(filepath.Join(dir, "abc.jpg"), []byte("old"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "someone-else.jpg"), []byte("old"), 0644)
+
+	// 400x200: 왼쪽 절반은 빨강, 오른쪽 절반은 파랑
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			if x < 200 {
+				src.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			} else {
+				src.Set(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var picture bytes.Buffer
+	png.Encode(&picture, src)
+	cookie := newTestSession(t, "abc")
+
+	tests := []struct {
+		req    *http.Request
+		status int
+	}{
+		{newUploadRequest(t, picture.Bytes(), nil), http.StatusUnauthorized},
+		{newUploadRequest(t, []byte("<html>not an image</html>"), cookie), http.StatusUnsupportedMediaType},
+		{newUploadRequest(t, picture.Bytes()[:100], cookie), http.StatusUnsupportedMediaType},
+		{newUploadRequest(t, make([]byte, maxAvatarUpload+1), cookie), http.StatusRequestEntityTooLarge},
+		{newUploadRequest(t, picture.Bytes(), cookie), http.StatusOK},
+	}
+	var res uploadResponse
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		uploaderHandler(w, test.req)
+		if w.Code != test.status {
+			t.Errorf("%d: uploaderHandler wrongly returned %d: %s", i, w.Code, w.Body.String())
+		}
+		res = uploadResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Errorf("%d: uploaderHandler should answer JSON: %s", i, err)
+		}
+		if w.Code != http.StatusOK && res.Error == "" {
+			t.Errorf("%d: uploaderHandler should explain the error", i)
+		}
+	}
+	if res.AvatarURL != "/avatars/abc.png" {
+		t.Errorf("uploaderHandler wrongly returned %q", res.AvatarURL)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 || files[0].Name() != "abc.png" || files[1].Name() != "someone-else.jpg" {
+		t.Errorf("the avatar should replace only the user's own files, got %v", files)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "abc.png")); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0644 {
+		t.Errorf("the avatar should be stored with 0644, got %v", info.Mode())
+	}
+	f, err := os.Open(filepath.Join(dir, "abc.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stored, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("the avatar should be a PNG: %s", err)
+	}
+	if b := stored.Bounds(); b.Dx() != avatarSize || b.Dy() != avatarSize {
+		t.Errorf("the avatar should be %dx%d, got %v", avatarSize, avatarSize, b)
+	}
+	// 가운데 정사각형을 잘랐으므로 양쪽 끝에 빨강과 파랑이 남는다.
+	if r, _, _, _ := stored.At(0, avatarSize/2).RGBA(); r>>8 != 255 {
+		t.Error("the left of the avatar should be red")
+	}
+	if _, _, b, _ := stored.At(avatarSize-1, avatarSize/2).RGBA(); b>>8 != 255 {
+		t.Error("the right of the avatar should be blue")
+	}
+}
+
+func TestUploaderHandlerHTML(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/uploader", nil)
+	w := httptest.NewRecorder()
+	uploaderHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("uploaderHandler wrongly returned %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("uploaderHandler should answer HTML by default, got %s", ct)
+	}
+}